@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AccessLogHandler is structured JSON request logging middleware, wrapping
+// the mux assembled in main.go. Unlike logMiddleware's one-line-to-stderr
+// debug trace, it writes one JSON object per request to server.access_log,
+// including the device identity resolved via AuthManager.ValidateToken, so
+// access can be audited after the fact without cross-referencing the
+// WebSocket logs.
+type AccessLogHandler struct {
+	next http.Handler
+	auth *AuthManager
+	cfg  AccessLogConfig
+
+	mu       sync.Mutex
+	file     *os.File
+	openedAt time.Time
+	size     int64
+}
+
+type accessLogEntry struct {
+	Time             string  `json:"time"`
+	Method           string  `json:"method"`
+	Path             string  `json:"path"`
+	Query            string  `json:"query,omitempty"`
+	RemoteIP         string  `json:"remoteIp"`
+	DeviceID         string  `json:"deviceId,omitempty"`
+	Status           int     `json:"status"`
+	BytesWritten     int64   `json:"bytesWritten"`
+	RequestBytes     int64   `json:"requestBytes"`
+	DurationMs       float64 `json:"durationMs"`
+	TokenFingerprint string  `json:"tokenFingerprint,omitempty"`
+}
+
+// NewAccessLogHandler wraps next with access logging. A blank cfg.Path
+// disables file logging entirely - requests still pass through to next.
+func NewAccessLogHandler(next http.Handler, auth *AuthManager, cfg AccessLogConfig) (*AccessLogHandler, error) {
+	h := &AccessLogHandler{next: next, auth: auth, cfg: cfg}
+	if cfg.Path != "" {
+		if err := h.openLocked(); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func (h *AccessLogHandler) openLocked() error {
+	f, err := os.OpenFile(h.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	h.file = f
+	h.openedAt = time.Now()
+	h.size = 0
+	if info, err := f.Stat(); err == nil {
+		h.size = info.Size()
+	}
+	return nil
+}
+
+// Reopen closes and reopens the log file. Call this on SIGHUP so an
+// external logrotate that already renamed the file out from under us gets
+// a fresh descriptor, rather than continuing to write to the renamed file.
+func (h *AccessLogHandler) Reopen() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.file != nil {
+		h.file.Close()
+		h.file = nil
+	}
+	if h.cfg.Path == "" {
+		return nil
+	}
+	return h.openLocked()
+}
+
+// rotateIfNeededLocked renames the current log file aside once it exceeds
+// the configured size or age and opens a fresh one. This is vault-sync's
+// own size/age rotation, independent of the SIGHUP-triggered Reopen used
+// to cooperate with an external logrotate.
+func (h *AccessLogHandler) rotateIfNeededLocked() {
+	if h.file == nil {
+		return
+	}
+
+	sizeExceeded := h.cfg.MaxSizeMB > 0 && h.size >= int64(h.cfg.MaxSizeMB)*1024*1024
+	ageExceeded := h.cfg.MaxAgeDays > 0 && time.Since(h.openedAt) >= time.Duration(h.cfg.MaxAgeDays)*24*time.Hour
+	if !sizeExceeded && !ageExceeded {
+		return
+	}
+
+	h.file.Close()
+	rotated := fmt.Sprintf("%s.%s", h.cfg.Path, time.Now().UTC().Format("20060102T150405"))
+	if err := os.Rename(h.cfg.Path, rotated); err != nil {
+		log.Printf("access log: failed to rotate %s: %v", h.cfg.Path, err)
+	}
+	if err := h.openLocked(); err != nil {
+		log.Printf("access log: failed to reopen after rotation: %v", err)
+	}
+}
+
+// Close flushes and closes the underlying log file, e.g. during graceful
+// shutdown.
+func (h *AccessLogHandler) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.file == nil {
+		return nil
+	}
+	err := h.file.Close()
+	h.file = nil
+	return err
+}
+
+// statusRecorder wraps http.ResponseWriter to capture the status code and
+// byte count a handler actually wrote, neither of which http.ResponseWriter
+// exposes after the fact.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if !r.wroteHeader {
+		r.status = http.StatusOK
+		r.wroteHeader = true
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Hijack delegates to the embedded ResponseWriter's http.Hijacker when it
+// implements one. Without this, wrapping every request in statusRecorder
+// would break WebSocket upgrades: gorilla/websocket's Upgrade type-asserts
+// the ResponseWriter to http.Hijacker and fails if the wrapper doesn't
+// forward it.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("access log: underlying ResponseWriter does not implement http.Hijacker")
+	}
+	return hj.Hijack()
+}
+
+// Flush delegates to the embedded ResponseWriter's http.Flusher when it
+// implements one, so streaming responses wrapped by this recorder still
+// flush promptly instead of buffering until the handler returns.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (h *AccessLogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w}
+	h.next.ServeHTTP(rec, r)
+
+	if h.file == nil {
+		return
+	}
+
+	token := bearerToken(r)
+	deviceID, _, _ := h.auth.ValidateToken(token)
+
+	entry := accessLogEntry{
+		Time:         start.UTC().Format(time.RFC3339),
+		Method:       r.Method,
+		Path:         r.URL.Path,
+		Query:        r.URL.RawQuery,
+		RemoteIP:     remoteIP(r),
+		DeviceID:     deviceID,
+		Status:       rec.status,
+		BytesWritten: rec.bytes,
+		RequestBytes: r.ContentLength,
+		DurationMs:   float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if h.cfg.LogAuthFailures && rec.status == http.StatusUnauthorized && token != "" {
+		entry.TokenFingerprint = tokenFingerprint(token)
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("access log: failed to marshal entry: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.file == nil {
+		return
+	}
+	h.rotateIfNeededLocked()
+	n, err := h.file.Write(line)
+	if err != nil {
+		log.Printf("access log: failed to write entry: %v", err)
+		return
+	}
+	h.size += int64(n)
+}
+
+// remoteIP strips the port from r.RemoteAddr, falling back to the raw value
+// if it isn't in host:port form.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// tokenFingerprint returns a short SHA-256 prefix of token - enough to
+// correlate repeated rejected attempts in the log without ever writing the
+// raw token, so the access log itself can't leak a credential.
+func tokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:6])
+}
@@ -6,54 +6,150 @@ import (
 	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
 
 type AuthManager struct {
-	masterToken  string
-	deviceTokens map[string]*DeviceToken
-	mu           sync.RWMutex
+	masterToken       string
+	deviceTokens      map[string]*DeviceToken
+	tokenStorePath    string
+	manifestStorePath string
+
+	// retired holds a just-rotated-out token for a short grace window (see
+	// RotateToken) so a client mid-rollover doesn't get a hard failure
+	// between fetching its new token and switching over to it. Keyed by the
+	// raw old token string; never persisted, since losing an in-flight
+	// grace window on restart is an acceptable tradeoff for not having to
+	// encrypt a second token generation to disk.
+	retired map[string]*retiredToken
+
+	// Cryptographic device identity (see device_identity.go): trusted and
+	// pending devices are keyed by DeviceID, and outstanding handshake
+	// challenges by the opaque nonce handed out via IssueChallenge.
+	trustedDevices map[string]*TrustedDevice
+	pendingDevices map[string]*PendingDevice
+	challenges     map[string]time.Time
+
+	// E2E encryption (see encryption.go): each device's enrolled X25519
+	// public key, and the current access manifest wrapping the vault root
+	// key for every authorized device. The server never sees the root key
+	// or plaintext content - manifest and wrapped keys are opaque to it.
+	encryptionKeys map[string][]byte
+	manifest       *EncryptionManifest
+
+	mu sync.RWMutex
 }
 
+// DeviceToken is a bearer credential scoped to one device. Scopes gates
+// which HTTP endpoints the token authorizes (e.g. "read", "write", "admin",
+// or a path-restricted "path:subdir/*"); ParentToken records the SHA-256
+// hash of the token this one rotated out via RotateToken, for audit
+// purposes only - it never holds the predecessor's raw secret. A zero
+// ExpiresAt means the token never expires.
 type DeviceToken struct {
-	Token     string    `json:"token"`
-	DeviceID  string    `json:"device_id"`
-	Name      string    `json:"name"`
-	CreatedAt time.Time `json:"created_at"`
-	LastSeen  time.Time `json:"last_seen"`
+	Token       string    `json:"token"`
+	DeviceID    string    `json:"device_id"`
+	Name        string    `json:"name"`
+	Scopes      []string  `json:"scopes"`
+	ExpiresAt   time.Time `json:"expires_at,omitempty"`
+	ParentToken string    `json:"parent_token,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// retiredToken is a rotated-out DeviceToken kept valid until validUntil so
+// in-flight clients don't get cut off mid-rollover (see RotateToken).
+type retiredToken struct {
+	token      *DeviceToken
+	validUntil time.Time
 }
 
-func NewAuthManager(masterToken string) *AuthManager {
-	return &AuthManager{
-		masterToken:  masterToken,
-		deviceTokens: make(map[string]*DeviceToken),
+// defaultTokenScopes is granted to tokens issued without an explicit scope
+// list, preserving the pre-scopes behavior of full read/write access.
+var defaultTokenScopes = []string{"read", "write"}
+
+// tokenRotationGrace is how long a rotated-out token keeps working after
+// RotateToken issues its replacement.
+const tokenRotationGrace = 5 * time.Minute
+
+// NewAuthManager loads any previously persisted device tokens from
+// tokenStorePath (encrypted at rest - see tokenstore.go) and any previously
+// published access manifest from manifestStorePath (see encryption.go), and
+// returns a ready AuthManager. An empty path disables persistence for that
+// piece of state; tokenStorePath == "" mirrors tokens' pre-chunk1-6,
+// memory-only behavior, and manifestStorePath == "" mirrors the manifest's
+// pre-chunk1-7 behavior of not surviving a restart.
+func NewAuthManager(masterToken string, tokenStorePath string, manifestStorePath string) (*AuthManager, error) {
+	a := &AuthManager{
+		masterToken:       masterToken,
+		deviceTokens:      make(map[string]*DeviceToken),
+		tokenStorePath:    tokenStorePath,
+		manifestStorePath: manifestStorePath,
+		retired:           make(map[string]*retiredToken),
+		trustedDevices:    make(map[string]*TrustedDevice),
+		pendingDevices:    make(map[string]*PendingDevice),
+		challenges:        make(map[string]time.Time),
+		encryptionKeys:    make(map[string][]byte),
+	}
+
+	if err := a.loadTokens(); err != nil {
+		return nil, err
 	}
+	if err := a.loadManifest(); err != nil {
+		return nil, err
+	}
+	return a, nil
 }
 
-func (a *AuthManager) ValidateToken(token string) (string, bool) {
+// ValidateToken resolves token to the identity and scopes it authorizes.
+// deviceID == "" means the token is unrecognized. expired is only
+// meaningful when deviceID != "": it tells the caller the token matched a
+// known device but has passed its ExpiresAt, which callers should treat the
+// same as an invalid token while still being able to log which device it
+// was. The master token always resolves to ("master", ["admin"], false).
+func (a *AuthManager) ValidateToken(token string) (deviceID string, scopes []string, expired bool) {
 	if token == "" {
-		return "", false
+		return "", nil, false
 	}
 
 	// Check master token first
 	if a.masterToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.masterToken)) == 1 {
-		return "master", true
+		return "master", []string{"admin"}, false
 	}
 
-	// Check device tokens
 	a.mu.RLock()
 	defer a.mu.RUnlock()
 
 	for _, dt := range a.deviceTokens {
 		if subtle.ConstantTimeCompare([]byte(token), []byte(dt.Token)) == 1 {
-			return dt.DeviceID, true
+			return dt.DeviceID, dt.Scopes, !dt.ExpiresAt.IsZero() && time.Now().After(dt.ExpiresAt)
+		}
+	}
+
+	for _, rt := range a.retired {
+		if time.Now().Before(rt.validUntil) && subtle.ConstantTimeCompare([]byte(token), []byte(rt.token.Token)) == 1 {
+			return rt.token.DeviceID, rt.token.Scopes, false
 		}
 	}
 
-	return "", false
+	return "", nil, false
+}
+
+// Authenticate resolves r's bearer token to a device identity and its
+// scopes, folding the expired case into a plain false so HTTP handlers
+// don't need to check both return values themselves.
+func (a *AuthManager) Authenticate(r *http.Request) (deviceID string, scopes []string, ok bool) {
+	deviceID, scopes, expired := a.ValidateToken(bearerToken(r))
+	if deviceID == "" || expired {
+		return "", nil, false
+	}
+	return deviceID, scopes, true
 }
 
 func (a *AuthManager) UpdateLastSeen(deviceID string) {
@@ -68,33 +164,111 @@ func (a *AuthManager) UpdateLastSeen(deviceID string) {
 	}
 }
 
-func (a *AuthManager) GenerateDeviceToken(deviceID, name string) (*DeviceToken, error) {
+// GenerateDeviceToken issues a new bearer token for deviceID. An empty
+// scopes defaults to defaultTokenScopes; ttl <= 0 means the token never
+// expires.
+func (a *AuthManager) GenerateDeviceToken(deviceID, name string, scopes []string, ttl time.Duration) (*DeviceToken, error) {
 	token, err := generateSecureToken(32)
 	if err != nil {
 		return nil, err
 	}
+	if len(scopes) == 0 {
+		scopes = defaultTokenScopes
+	}
 
 	dt := &DeviceToken{
 		Token:     token,
 		DeviceID:  deviceID,
 		Name:      name,
+		Scopes:    scopes,
 		CreatedAt: time.Now(),
 		LastSeen:  time.Now(),
 	}
+	if ttl > 0 {
+		dt.ExpiresAt = dt.CreatedAt.Add(ttl)
+	}
 
 	a.mu.Lock()
 	a.deviceTokens[deviceID] = dt
+	err = a.persistTokensLocked()
 	a.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
 
 	return dt, nil
 }
 
+// RotateToken issues deviceID a fresh random secret with the same scopes
+// and expiry as the token it was called with, then retires the old token
+// for tokenRotationGrace instead of invalidating it immediately, so a
+// client can switch over to the new secret without a window where neither
+// token works.
+func (a *AuthManager) RotateToken(oldToken string) (*DeviceToken, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.pruneRetiredLocked()
+
+	var old *DeviceToken
+	for _, dt := range a.deviceTokens {
+		if subtle.ConstantTimeCompare([]byte(oldToken), []byte(dt.Token)) == 1 {
+			old = dt
+			break
+		}
+	}
+	if old == nil {
+		return nil, errors.New("unknown or already-rotated token")
+	}
+	if !old.ExpiresAt.IsZero() && time.Now().After(old.ExpiresAt) {
+		return nil, errors.New("token has expired")
+	}
+
+	newSecret, err := generateSecureToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	newDT := &DeviceToken{
+		Token:       newSecret,
+		DeviceID:    old.DeviceID,
+		Name:        old.Name,
+		Scopes:      old.Scopes,
+		ExpiresAt:   old.ExpiresAt,
+		ParentToken: hashToken(old.Token),
+		CreatedAt:   time.Now(),
+		LastSeen:    time.Now(),
+	}
+
+	a.deviceTokens[old.DeviceID] = newDT
+	a.retired[old.Token] = &retiredToken{token: old, validUntil: time.Now().Add(tokenRotationGrace)}
+
+	if err := a.persistTokensLocked(); err != nil {
+		return nil, err
+	}
+	return newDT, nil
+}
+
+// pruneRetiredLocked drops retired tokens past their grace window. Callers
+// must hold a.mu.
+func (a *AuthManager) pruneRetiredLocked() {
+	now := time.Now()
+	for token, rt := range a.retired {
+		if now.After(rt.validUntil) {
+			delete(a.retired, token)
+		}
+	}
+}
+
 func (a *AuthManager) RevokeDeviceToken(deviceID string) bool {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
 	if _, exists := a.deviceTokens[deviceID]; exists {
 		delete(a.deviceTokens, deviceID)
+		if err := a.persistTokensLocked(); err != nil {
+			log.Printf("Failed to persist token store after revoking %s: %v", deviceID, err)
+		}
 		return true
 	}
 	return false
@@ -110,6 +284,8 @@ func (a *AuthManager) ListDevices() []*DeviceToken {
 		devices = append(devices, &DeviceToken{
 			DeviceID:  dt.DeviceID,
 			Name:      dt.Name,
+			Scopes:    dt.Scopes,
+			ExpiresAt: dt.ExpiresAt,
 			CreatedAt: dt.CreatedAt,
 			LastSeen:  dt.LastSeen,
 		})
@@ -145,8 +321,10 @@ func (a *AuthManager) HandleGenerateToken(w http.ResponseWriter, r *http.Request
 	}
 
 	var req struct {
-		DeviceID string `json:"device_id"`
-		Name     string `json:"name"`
+		DeviceID   string   `json:"device_id"`
+		Name       string   `json:"name"`
+		Scopes     []string `json:"scopes,omitempty"`
+		TTLSeconds int      `json:"ttl_seconds,omitempty"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -158,7 +336,7 @@ func (a *AuthManager) HandleGenerateToken(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	dt, err := a.GenerateDeviceToken(req.DeviceID, req.Name)
+	dt, err := a.GenerateDeviceToken(req.DeviceID, req.Name, req.Scopes, time.Duration(req.TTLSeconds)*time.Second)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to generate token: %v", err), http.StatusInternalServerError)
 		return
@@ -168,7 +346,35 @@ func (a *AuthManager) HandleGenerateToken(w http.ResponseWriter, r *http.Request
 	json.NewEncoder(w).Encode(dt)
 }
 
-// HTTP handler for listing devices (master token required)
+// HandleRotateToken lets a device currently holding a valid (non-expired)
+// token exchange it for a replacement with the same scopes and expiry but a
+// fresh random secret. The old token keeps working for tokenRotationGrace
+// so a client mid-rollover isn't locked out between requests.
+func (a *AuthManager) HandleRotateToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	oldToken := bearerToken(r)
+	if oldToken == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	dt, err := a.RotateToken(oldToken)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dt)
+}
+
+// HTTP handler for listing devices (master token required). An optional
+// ?scope= query param restricts the result to devices whose token grants
+// that scope (an "admin"-scoped token matches any requested scope).
 func (a *AuthManager) HandleListDevices(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -181,6 +387,215 @@ func (a *AuthManager) HandleListDevices(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	devices := a.ListDevices()
+	if scope := r.URL.Query().Get("scope"); scope != "" {
+		filtered := make([]*DeviceToken, 0, len(devices))
+		for _, dt := range devices {
+			if hasScope(dt.Scopes, scope) {
+				filtered = append(filtered, dt)
+			}
+		}
+		devices = filtered
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(devices)
+}
+
+// HandleDeviceChallenge issues a one-time nonce a prospective device signs
+// with its private key to prove identity when connecting to /ws. No auth
+// is required since the device isn't authenticated yet.
+func (a *AuthManager) HandleDeviceChallenge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	nonce, err := a.IssueChallenge()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to issue challenge: %v", err), http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(a.ListDevices())
+	json.NewEncoder(w).Encode(map[string]string{"nonce": nonce})
+}
+
+// HandlePendingDevices lists devices awaiting operator approval (master
+// token required).
+func (a *AuthManager) HandlePendingDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" || authHeader != "Bearer "+a.masterToken {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.PendingDevices())
+}
+
+// HandleApproveDevice moves a pending device into the trusted set (master
+// token required).
+func (a *AuthManager) HandleApproveDevice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" || authHeader != "Bearer "+a.masterToken {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		DeviceID string `json:"device_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.DeviceID == "" {
+		http.Error(w, "device_id is required", http.StatusBadRequest)
+		return
+	}
+
+	if !a.ApproveDevice(req.DeviceID) {
+		http.Error(w, "No such pending device", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"device_id": req.DeviceID, "status": "approved"})
+}
+
+// HandleEnrollEncryptionKey lets an authenticated device register the
+// X25519 public key other devices should wrap the vault root key to (see
+// encryption.go). The device must already be trusted via the identity
+// handshake; a bearer token alone isn't enough.
+func (a *AuthManager) HandleEnrollEncryptionKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deviceID, scopes, ok := a.Authenticate(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !hasScope(scopes, "write") {
+		http.Error(w, "Token does not grant write scope", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		PublicKey []byte `json:"public_key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.PublicKey) == 0 {
+		http.Error(w, "public_key is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := a.EnrollEncryptionKey(deviceID, req.PublicKey); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"device_id": deviceID, "status": "enrolled"})
+}
+
+// HandleManifest serves GET to fetch the current access manifest and PUT to
+// publish a new one (see encryption.go). Fetching needs a token with read
+// scope and publishing one with write scope; beyond that, publishing is
+// gated by PublishManifest's signature and version checks, since the server
+// can't tell a vault owner from any other device.
+func (a *AuthManager) HandleManifest(w http.ResponseWriter, r *http.Request) {
+	_, scopes, ok := a.Authenticate(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if !hasScope(scopes, "read") {
+			http.Error(w, "Token does not grant read scope", http.StatusForbidden)
+			return
+		}
+		manifest, ok := a.Manifest()
+		if !ok {
+			http.Error(w, "No manifest published yet", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(manifest)
+
+	case http.MethodPut:
+		if !hasScope(scopes, "write") {
+			http.Error(w, "Token does not grant write scope", http.StatusForbidden)
+			return
+		}
+		var m EncryptionManifest
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			http.Error(w, "Invalid manifest body", http.StatusBadRequest)
+			return
+		}
+		if err := a.PublishManifest(&m); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"version": m.Version})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// hasScope reports whether scopes authorizes required. "admin" (granted by
+// the master token) authorizes everything.
+func hasScope(scopes []string, required string) bool {
+	for _, s := range scopes {
+		if s == "admin" || s == required {
+			return true
+		}
+	}
+	return false
+}
+
+// pathScopeAllows reports whether scopes authorizes a write/read to path,
+// either via an unrestricted "admin"/required scope or a path-restricted
+// scope of the form "path:<prefix>/*" (or an exact "path:<path>").
+func pathScopeAllows(scopes []string, required, path string) bool {
+	if hasScope(scopes, required) {
+		return true
+	}
+	for _, s := range scopes {
+		rest, ok := strings.CutPrefix(s, "path:")
+		if !ok {
+			continue
+		}
+		if prefix, ok := strings.CutSuffix(rest, "/*"); ok {
+			if path == prefix || strings.HasPrefix(path, prefix+"/") {
+				return true
+			}
+		} else if rest == path {
+			return true
+		}
+	}
+	return false
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>"
+// header, or "" if the header is missing or malformed.
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return ""
+	}
+	return strings.TrimPrefix(header, prefix)
 }
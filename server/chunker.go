@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"math/bits"
+)
+
+// Content-defined chunking (FastCDC) for chunked uploads with server-side
+// dedup (see ChunkStore in storagebackend.go). Unlike the fixed-size block
+// ladder used for block-based delta sync (storage.go's
+// chooseBlockSize/splitIntoBlocks), chunk boundaries here are determined by
+// the content itself via a rolling Gear hash, so inserting or deleting a few
+// bytes only shifts the chunks immediately around the edit instead of every
+// fixed-size block after it.
+const (
+	minChunkSize = 2 * 1024
+	avgChunkSize = 8 * 1024
+	maxChunkSize = 64 * 1024
+
+	// normalizationLevel widens the gap between maskS and maskL around
+	// avgChunkSize's bit width, concentrating the chunk-size distribution
+	// more tightly around the average (FastCDC's "normalized chunking").
+	normalizationLevel = 2
+)
+
+var (
+	gearTable = generateGearTable()
+	maskS     = uint64(1)<<(bits.Len(uint(avgChunkSize))-1+normalizationLevel) - 1
+	maskL     = uint64(1)<<(bits.Len(uint(avgChunkSize))-1-normalizationLevel) - 1
+)
+
+// generateGearTable derives 256 pseudo-random 64-bit values for the Gear
+// hash by repeatedly hashing a fixed seed, rather than hard-coding a table.
+func generateGearTable() [256]uint64 {
+	var table [256]uint64
+	seed := sha256.Sum256([]byte("vault-sync fastcdc gear table"))
+	for i := range table {
+		seed = sha256.Sum256(seed[:])
+		table[i] = binary.BigEndian.Uint64(seed[:8])
+	}
+	return table
+}
+
+// cdcChunkBoundary finds the end of the first content-defined chunk within
+// data, using FastCDC's normalized chunking: a stricter mask (maskS) below
+// avgChunkSize makes an early cut less likely, and a looser mask (maskL)
+// above it makes a cut more likely, pulling the distribution back toward
+// the average before maxChunkSize forces a cut regardless.
+func cdcChunkBoundary(data []byte) int {
+	n := len(data)
+	if n <= minChunkSize {
+		return n
+	}
+	if n > maxChunkSize {
+		n = maxChunkSize
+	}
+
+	mid := avgChunkSize
+	if mid > n {
+		mid = n
+	}
+
+	var fp uint64
+	i := minChunkSize
+	for ; i < mid; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// ChunkContentDefined splits content into variable-size, content-defined
+// chunks and SHA-256 hashes each one. The returned chunks are in file order
+// and cover content exactly; Offset is relative to the start of content.
+func ChunkContentDefined(content []byte) []BlockInfo {
+	if len(content) == 0 {
+		return nil
+	}
+
+	var chunks []BlockInfo
+	var offset int64
+	remaining := content
+	for len(remaining) > 0 {
+		cut := cdcChunkBoundary(remaining)
+		chunk := remaining[:cut]
+		sum := sha256.Sum256(chunk)
+
+		chunks = append(chunks, BlockInfo{
+			Offset: offset,
+			Size:   int64(len(chunk)),
+			Hash:   hex.EncodeToString(sum[:]),
+		})
+
+		offset += int64(len(chunk))
+		remaining = remaining[cut:]
+	}
+	return chunks
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Content-addressed chunk store, used for content-defined chunked uploads
+// with server-side dedup (see chunker.go). Mirrors the block store's
+// on-disk layout (storage.go's blockPath/manifestPath) but keeps its own
+// reserved directories so the two chunking schemes never collide. Both
+// names start with "." so ListFiles/rebuildHashCache's existing
+// hidden-directory skip keeps them out of vault content without any extra
+// special-casing.
+const (
+	chunksDirName         = ".chunks"
+	chunkManifestsDirName = ".chunk-manifests"
+)
+
+// ChunkManifest is a file represented as an ordered list of content-defined
+// chunk hashes. TotalHash is still the whole-file SHA-256 (what GetFileHash
+// and FileInfo.Hash report) so existing peers that only understand
+// whole-file hashes keep working unchanged.
+type ChunkManifest struct {
+	Path      string      `json:"path"`
+	MTime     int64       `json:"mtime"`
+	TotalHash string      `json:"totalHash"`
+	Chunks    []BlockInfo `json:"chunks"`
+}
+
+var _ ChunkStore = (*Storage)(nil)
+
+// buildChunkManifest computes a ChunkManifest for content as FastCDC would
+// split it.
+func buildChunkManifest(path string, content []byte, mtime int64) *ChunkManifest {
+	totalHash := sha256.Sum256(content)
+	return &ChunkManifest{
+		Path:      path,
+		MTime:     mtime,
+		TotalHash: hex.EncodeToString(totalHash[:]),
+		Chunks:    ChunkContentDefined(content),
+	}
+}
+
+func (s *Storage) chunkPath(hash string) (string, error) {
+	if len(hash) < 2 {
+		return "", ErrInvalidPath
+	}
+	return filepath.Join(s.basePath, chunksDirName, hash[0:2], hash), nil
+}
+
+// HasChunk reports whether a chunk with the given hash is already stored.
+func (s *Storage) HasChunk(hash string) bool {
+	path, err := s.chunkPath(hash)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// WriteChunk stores a chunk under its content hash, skipping the write if
+// it's already present - the basis of upload dedup.
+func (s *Storage) WriteChunk(hash string, data []byte) error {
+	path, err := s.chunkPath(hash)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		return nil // Already have this chunk
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
+
+// ReadChunk reads a previously stored chunk by hash.
+func (s *Storage) ReadChunk(hash string) ([]byte, error) {
+	path, err := s.chunkPath(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrBlockNotFound
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// ReconstructFromChunkManifest rebuilds a file's content by concatenating
+// its chunks in order.
+func (s *Storage) ReconstructFromChunkManifest(m *ChunkManifest) ([]byte, error) {
+	var size int64
+	for _, c := range m.Chunks {
+		if end := c.Offset + c.Size; end > size {
+			size = end
+		}
+	}
+
+	content := make([]byte, size)
+	for _, c := range m.Chunks {
+		data, err := s.ReadChunk(c.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("chunk %s for %s: %w", c.Hash, m.Path, err)
+		}
+		copy(content[c.Offset:c.Offset+c.Size], data)
+	}
+	return content, nil
+}
+
+func (s *Storage) chunkManifestPath(path string) (string, error) {
+	fullPath, err := s.validatePath(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(s.basePath, fullPath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.basePath, chunkManifestsDirName, rel+".json"), nil
+}
+
+// SaveChunkManifest persists path's chunk manifest so future uploads can be
+// diffed against it and so GCChunks knows which chunks are still referenced.
+func (s *Storage) SaveChunkManifest(path string, m *ChunkManifest) error {
+	manifestPath, err := s.chunkManifestPath(path)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(manifestPath), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(manifestPath, data, 0644)
+}
+
+// GetChunkManifest loads the stored chunk manifest for path, if any.
+func (s *Storage) GetChunkManifest(path string) (*ChunkManifest, bool) {
+	manifestPath, err := s.chunkManifestPath(path)
+	if err != nil {
+		return nil, false
+	}
+
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, false
+	}
+
+	var m ChunkManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, false
+	}
+	return &m, true
+}
+
+// ListChunkManifests returns every stored chunk manifest - the "chunk-list
+// projection" peers use to do delta sync against the content-defined store,
+// alongside the whole-file listing ListFiles already provides.
+func (s *Storage) ListChunkManifests() []*ChunkManifest {
+	var manifests []*ChunkManifest
+
+	root := filepath.Join(s.basePath, chunkManifestsDirName)
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		var m ChunkManifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil
+		}
+		manifests = append(manifests, &m)
+		return nil
+	})
+
+	return manifests
+}
+
+// GCChunks sweeps the chunk store for hashes no longer referenced by any
+// chunk manifest. Intended to run as routine maintenance alongside
+// CleanupExpiredTombstones, since a file's old chunks become unreferenced
+// the moment it's overwritten or deleted and its manifest is replaced.
+func (s *Storage) GCChunks() (int, error) {
+	referenced := make(map[string]bool)
+	for _, m := range s.ListChunkManifests() {
+		for _, c := range m.Chunks {
+			referenced[c.Hash] = true
+		}
+	}
+
+	root := filepath.Join(s.basePath, chunksDirName)
+	removed := 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		hash := d.Name()
+		if referenced[hash] {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	if err != nil {
+		return removed, err
+	}
+
+	return removed, nil
+}
@@ -12,21 +12,78 @@ type Config struct {
 	Storage StorageConfig `yaml:"storage"`
 	Auth    AuthConfig    `yaml:"auth"`
 	Sync    SyncConfig    `yaml:"sync"`
+	Retry   RetryPolicy   `yaml:"retry"`
 }
 
 type ServerConfig struct {
-	Port int       `yaml:"port"`
-	TLS  TLSConfig `yaml:"tls"`
+	Port           int                  `yaml:"port"`
+	TLS            TLSConfig            `yaml:"tls"`
+	FaultInjection FaultInjectionConfig `yaml:"fault_injection"`
+	AccessLog      AccessLogConfig      `yaml:"access_log"`
+}
+
+// AccessLogConfig configures the structured JSON request log (see
+// AccessLogHandler in accesslog.go). Path empty disables it. Rotation is
+// size/age based on top of whatever an external logrotate already does;
+// SIGHUP reopens the file so the two don't fight over the same descriptor.
+type AccessLogConfig struct {
+	Path            string `yaml:"path"`
+	MaxSizeMB       int    `yaml:"max_size_mb"`
+	MaxAgeDays      int    `yaml:"max_age_days"`
+	LogAuthFailures bool   `yaml:"log_auth_failures"`
 }
 
 type TLSConfig struct {
-	Enabled bool   `yaml:"enabled"`
-	Cert    string `yaml:"cert"`
-	Key     string `yaml:"key"`
+	Enabled  bool   `yaml:"enabled"`
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	ClientCA string `yaml:"client_ca"` // Optional: enables mutual TLS device auth
+}
+
+// FaultInjectionConfig lets operators deliberately destabilize the
+// WebSocket transport to exercise the retry/reconnect path in integration
+// tests. Never enable this in production.
+type FaultInjectionConfig struct {
+	Enabled                 bool    `yaml:"enabled"`
+	WriteFailureProbability float64 `yaml:"write_failure_probability"`
+	LatencyMs               int     `yaml:"latency_ms"`
+	DisconnectProbability   float64 `yaml:"disconnect_probability"`
+}
+
+// RetryPolicy governs how the hub redelivers queued outbound messages to a
+// device that was unreachable or slow to drain.
+type RetryPolicy struct {
+	InitialBackoffMs int     `yaml:"initial_backoff_ms"`
+	MaxBackoffMs     int     `yaml:"max_backoff_ms"`
+	Multiplier       float64 `yaml:"multiplier"`
+	MaxAttempts      int     `yaml:"max_attempts"`
 }
 
+// StorageConfig selects and configures the storage backend. Type defaults
+// to "local" for configs written before this option existed; Path is the
+// local backend's root directory. S3/WebDAV are only read when Type
+// selects them.
 type StorageConfig struct {
-	Path string `yaml:"path"`
+	Type   string       `yaml:"type"`
+	Path   string       `yaml:"path"`
+	S3     S3Config     `yaml:"s3"`
+	WebDAV WebDAVConfig `yaml:"webdav"`
+}
+
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint"`
+	Bucket    string `yaml:"bucket"`
+	Region    string `yaml:"region"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	Prefix    string `yaml:"prefix"`
+}
+
+type WebDAVConfig struct {
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Prefix   string `yaml:"prefix"`
 }
 
 type AuthConfig struct {
@@ -34,9 +91,11 @@ type AuthConfig struct {
 }
 
 type SyncConfig struct {
-	ConflictResolution string `yaml:"conflict_resolution"`
-	DebounceMs         int    `yaml:"debounce_ms"`
-	MaxFileSizeMB      int    `yaml:"max_file_size_mb"`
+	ConflictResolution     string `yaml:"conflict_resolution"`
+	DebounceMs             int    `yaml:"debounce_ms"`
+	MaxFileSizeMB          int    `yaml:"max_file_size_mb"`
+	MaxInFlightMB          int    `yaml:"max_in_flight_mb"`
+	PerDeviceMaxRequestKiB int    `yaml:"per_device_max_request_kib"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -52,9 +111,17 @@ func LoadConfig(path string) (*Config, error) {
 		},
 		Auth: AuthConfig{},
 		Sync: SyncConfig{
-			ConflictResolution: "last_write_wins",
-			DebounceMs:         500,
-			MaxFileSizeMB:      50,
+			ConflictResolution:     "last_write_wins",
+			DebounceMs:             500,
+			MaxFileSizeMB:          50,
+			MaxInFlightMB:          256,
+			PerDeviceMaxRequestKiB: 65536,
+		},
+		Retry: RetryPolicy{
+			InitialBackoffMs: 500,
+			MaxBackoffMs:     30000,
+			Multiplier:       2.0,
+			MaxAttempts:      10,
 		},
 	}
 
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidDeviceID  = errors.New("device id does not match public key")
+	ErrChallengeInvalid = errors.New("challenge invalid or expired")
+)
+
+const deviceIDAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567" // RFC 4648 base32
+
+// DeriveDeviceID computes a Syncthing-style device ID from a device's
+// DER-encoded public key: base32(SHA-256(pubKey)), split into four 13-char
+// groups each followed by a Luhn mod-32 check character, dash-grouped every
+// seven characters so a transcription typo is caught client-side instead
+// of silently connecting to the wrong device.
+func DeriveDeviceID(pubKeyDER []byte) (string, error) {
+	sum := sha256.Sum256(pubKeyDER)
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(sum[:])
+
+	checked, err := luhnifyGroups(encoded)
+	if err != nil {
+		return "", err
+	}
+	return dashGroup(checked), nil
+}
+
+func luhnifyGroups(s string) (string, error) {
+	if len(s) != 52 {
+		return "", fmt.Errorf("unexpected encoded length %d", len(s))
+	}
+
+	var b strings.Builder
+	for i := 0; i < 4; i++ {
+		group := s[i*13 : (i+1)*13]
+		b.WriteString(group)
+		b.WriteByte(luhn32CheckDigit(group))
+	}
+	return b.String(), nil
+}
+
+// luhn32CheckDigit computes a Luhn mod-32 check character over s.
+func luhn32CheckDigit(s string) byte {
+	factor := 1
+	sum := 0
+	n := len(deviceIDAlphabet)
+
+	for i := 0; i < len(s); i++ {
+		codepoint := strings.IndexByte(deviceIDAlphabet, s[i])
+		addend := factor * codepoint
+		addend = (addend / n) + (addend % n)
+		sum += addend
+		if factor == 2 {
+			factor = 1
+		} else {
+			factor = 2
+		}
+	}
+
+	remainder := sum % n
+	checkCodepoint := (n - remainder) % n
+	return deviceIDAlphabet[checkCodepoint]
+}
+
+func dashGroup(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i += 7 {
+		if i > 0 {
+			b.WriteByte('-')
+		}
+		end := i + 7
+		if end > len(s) {
+			end = len(s)
+		}
+		b.WriteString(s[i:end])
+	}
+	return b.String()
+}
+
+// TrustedDevice is a device the operator has approved to connect over /ws.
+// Pinning the public key means a later handshake claiming the same
+// DeviceID with a different key is rejected rather than silently trusted.
+type TrustedDevice struct {
+	DeviceID   string    `json:"deviceId"`
+	PublicKey  []byte    `json:"publicKey"` // DER-encoded
+	Name       string    `json:"name,omitempty"`
+	ApprovedAt time.Time `json:"approvedAt"`
+}
+
+// PendingDevice is waiting on operator approval via /api/devices/pending.
+type PendingDevice struct {
+	DeviceID    string    `json:"deviceId"`
+	PublicKey   []byte    `json:"publicKey"`
+	Name        string    `json:"name,omitempty"`
+	RequestedAt time.Time `json:"requestedAt"`
+}
+
+const challengeTTL = 60 * time.Second
+
+// IssueChallenge generates an opaque nonce a device must sign with its
+// private key to prove possession before its /ws connection is accepted.
+func (a *AuthManager) IssueChallenge() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	nonce := base64.StdEncoding.EncodeToString(buf)
+
+	a.mu.Lock()
+	a.challenges[nonce] = time.Now().Add(challengeTTL)
+	a.mu.Unlock()
+
+	return nonce, nil
+}
+
+// consumeChallenge validates and invalidates a previously issued nonce, so
+// each challenge can only ever authorize a single handshake.
+func (a *AuthManager) consumeChallenge(nonce string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	expiry, ok := a.challenges[nonce]
+	if !ok {
+		return false
+	}
+	delete(a.challenges, nonce)
+	return time.Now().Before(expiry)
+}
+
+// VerifyDeviceHandshake checks that pubKeyDER's signature over nonce is
+// valid, that deviceID matches the ID derived from pubKeyDER, and that the
+// nonce was actually issued and not yet used. It does not check trust —
+// callers should follow up with IsTrusted.
+func (a *AuthManager) VerifyDeviceHandshake(deviceID string, pubKeyDER []byte, nonce string, signature []byte) error {
+	if !a.consumeChallenge(nonce) {
+		return ErrChallengeInvalid
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(pubKeyDER)
+	if err != nil {
+		return fmt.Errorf("parsing public key: %w", err)
+	}
+	edPub, ok := pub.(ed25519.PublicKey)
+	if !ok {
+		return errors.New("unsupported public key type, expected Ed25519")
+	}
+
+	if !ed25519.Verify(edPub, []byte(nonce), signature) {
+		return errors.New("invalid signature")
+	}
+
+	derivedID, err := DeriveDeviceID(pubKeyDER)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(derivedID), []byte(deviceID)) != 1 {
+		return ErrInvalidDeviceID
+	}
+
+	return nil
+}
+
+// RequestDeviceApproval queues a newly-seen device for operator approval.
+func (a *AuthManager) RequestDeviceApproval(deviceID string, pubKeyDER []byte, name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, exists := a.pendingDevices[deviceID]; exists {
+		return
+	}
+	a.pendingDevices[deviceID] = &PendingDevice{
+		DeviceID:    deviceID,
+		PublicKey:   pubKeyDER,
+		Name:        name,
+		RequestedAt: time.Now(),
+	}
+}
+
+// IsTrusted reports whether deviceID has been approved, with its public key
+// pinned to the one it was approved with.
+func (a *AuthManager) IsTrusted(deviceID string, pubKeyDER []byte) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	trusted, ok := a.trustedDevices[deviceID]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare(trusted.PublicKey, pubKeyDER) == 1
+}
+
+// PendingDevices lists devices awaiting operator approval.
+func (a *AuthManager) PendingDevices() []*PendingDevice {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	devices := make([]*PendingDevice, 0, len(a.pendingDevices))
+	for _, d := range a.pendingDevices {
+		devices = append(devices, d)
+	}
+	return devices
+}
+
+// ApproveDevice moves a pending device into the trusted set.
+func (a *AuthManager) ApproveDevice(deviceID string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	pending, ok := a.pendingDevices[deviceID]
+	if !ok {
+		return false
+	}
+	delete(a.pendingDevices, deviceID)
+	a.trustedDevices[deviceID] = &TrustedDevice{
+		DeviceID:   deviceID,
+		PublicKey:  pending.PublicKey,
+		Name:       pending.Name,
+		ApprovedAt: time.Now(),
+	}
+	return true
+}
+
+// RejectDevice drops a pending device request without trusting it.
+func (a *AuthManager) RejectDevice(deviceID string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.pendingDevices[deviceID]; !ok {
+		return false
+	}
+	delete(a.pendingDevices, deviceID)
+	return true
+}
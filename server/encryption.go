@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// This file implements the optional end-to-end encryption layer described in
+// the access manifest design (see AuthManager.manifest in auth.go): the
+// server stores ciphertext, the manifest, and wrapped copies of the vault
+// root key, but never the root key itself or plaintext content. Clients are
+// responsible for encrypting file content and paths before calling
+// StorageBackend.WriteFile; this file only covers the key-wrapping and
+// manifest machinery the server participates in.
+
+const rootKeySize = 32
+
+// GenerateRootKey creates a new random vault root key. Called by the vault
+// owner when first enabling encryption, or when rotating after a
+// revocation; the server never sees the result.
+func GenerateRootKey() ([]byte, error) {
+	key := make([]byte, rootKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// DeriveFileKey derives a per-file symmetric key from the vault root key via
+// HKDF-SHA256, salted with fileID so that deriving (or leaking) one file's
+// key doesn't expose the rest of the vault or the root key itself.
+func DeriveFileKey(rootKey []byte, fileID string) ([]byte, error) {
+	h := hkdf.New(sha256.New, rootKey, []byte(fileID), []byte("vault-sync file key v1"))
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(h, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// WrappedKey is one device's ECIES-wrapped copy of the vault root key: an
+// ephemeral X25519 public key plus the ChaCha20-Poly1305 sealing of the root
+// key under a secret derived from ECDH(ephemeral, device's static key).
+type WrappedKey struct {
+	EphemeralPub []byte `json:"ephemeralPub"`
+	Nonce        []byte `json:"nonce"`
+	Ciphertext   []byte `json:"ciphertext"`
+}
+
+// WrapRootKey seals rootKey to recipientPub (a device's raw 32-byte X25519
+// public key, enrolled via AuthManager.EnrollEncryptionKey) using ECIES: a
+// fresh ephemeral key pair is generated and ECDH'd with the recipient's
+// static key, and the shared secret is run through HKDF to derive the
+// sealing key, so each wrapped copy uses an independent nonce space.
+func WrapRootKey(rootKey, recipientPub []byte) (*WrappedKey, error) {
+	curve := ecdh.X25519()
+	recipient, err := curve.NewPublicKey(recipientPub)
+	if err != nil {
+		return nil, fmt.Errorf("parsing recipient public key: %w", err)
+	}
+
+	ephemeral, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeralPub := ephemeral.PublicKey().Bytes()
+	aead, err := wrapAEAD(shared, ephemeralPub, recipientPub)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return &WrappedKey{
+		EphemeralPub: ephemeralPub,
+		Nonce:        nonce,
+		Ciphertext:   aead.Seal(nil, nonce, rootKey, nil),
+	}, nil
+}
+
+// UnwrapRootKey recovers the vault root key from a WrappedKey using the
+// recipient's raw 32-byte X25519 private key. Only the device the key was
+// wrapped for can succeed, since it's the only one that can reproduce the
+// ECDH shared secret.
+func UnwrapRootKey(wrapped *WrappedKey, recipientPriv []byte) ([]byte, error) {
+	curve := ecdh.X25519()
+	priv, err := curve.NewPrivateKey(recipientPriv)
+	if err != nil {
+		return nil, fmt.Errorf("parsing recipient private key: %w", err)
+	}
+
+	ephemeralPub, err := curve.NewPublicKey(wrapped.EphemeralPub)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ephemeral public key: %w", err)
+	}
+
+	shared, err := priv.ECDH(ephemeralPub)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := wrapAEAD(shared, wrapped.EphemeralPub, priv.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Open(nil, wrapped.Nonce, wrapped.Ciphertext, nil)
+}
+
+// wrapAEAD derives the ChaCha20-Poly1305 key used to seal a wrapped root key
+// from the ECDH shared secret, binding it to both public keys so a wrapped
+// key can't be replayed against a different ephemeral/recipient pairing.
+func wrapAEAD(shared, ephemeralPub, recipientPub []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, ephemeralPub...), recipientPub...)
+	h := hkdf.New(sha256.New, shared, salt, []byte("vault-sync key wrap v1"))
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(h, key); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
+
+// EncryptionManifest is the vault owner's published record of who can read
+// the vault: a wrapped copy of the root key for every authorized device,
+// signed with the owner's device identity key (the same Ed25519 key used
+// for the /ws handshake in device_identity.go) so the server can reject a
+// forged or tampered manifest without itself being able to produce one.
+// Revocation is "rotate and republish": the owner generates a new root key,
+// re-derives and re-wraps for the remaining devices, and bumps Version.
+type EncryptionManifest struct {
+	Version        int                   `json:"version"`
+	WrappedKeys    map[string]WrappedKey `json:"wrappedKeys"` // keyed by DeviceID
+	SignerDeviceID string                `json:"signerDeviceId"`
+	Signature      []byte                `json:"signature"`
+}
+
+// signingBytes returns the canonical bytes an EncryptionManifest's signature
+// covers: everything except the signature itself.
+func (m *EncryptionManifest) signingBytes() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = nil
+	return json.Marshal(unsigned)
+}
+
+// SignManifest signs m with the vault owner's Ed25519 device identity key.
+func SignManifest(m *EncryptionManifest, priv ed25519.PrivateKey) error {
+	data, err := m.signingBytes()
+	if err != nil {
+		return err
+	}
+	m.Signature = ed25519.Sign(priv, data)
+	return nil
+}
+
+// verifyManifestSignature checks m.Signature against signerPubDER, the
+// DER-encoded Ed25519 public key pinned for m.SignerDeviceID.
+func verifyManifestSignature(m *EncryptionManifest, signerPubDER []byte) error {
+	data, err := m.signingBytes()
+	if err != nil {
+		return err
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(signerPubDER)
+	if err != nil {
+		return fmt.Errorf("parsing signer public key: %w", err)
+	}
+	edPub, ok := pub.(ed25519.PublicKey)
+	if !ok {
+		return errors.New("unsupported signer public key type, expected Ed25519")
+	}
+
+	if !ed25519.Verify(edPub, data, m.Signature) {
+		return errors.New("invalid manifest signature")
+	}
+	return nil
+}
+
+// EnrollEncryptionKey stores deviceID's X25519 public key, which other
+// devices wrap the vault root key to when publishing a manifest. Enrollment
+// piggybacks on device identity trust (see device_identity.go) rather than
+// introducing a second approval queue.
+func (a *AuthManager) EnrollEncryptionKey(deviceID string, pubKey []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.trustedDevices[deviceID]; !ok {
+		return errors.New("device is not trusted")
+	}
+	a.encryptionKeys[deviceID] = pubKey
+	return nil
+}
+
+// EncryptionKey returns deviceID's enrolled X25519 public key, if any.
+func (a *AuthManager) EncryptionKey(deviceID string) ([]byte, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	key, ok := a.encryptionKeys[deviceID]
+	return key, ok
+}
+
+// PublishManifest validates and stores a new access manifest: the signer
+// must be a trusted device, the signature must verify against its pinned
+// identity key, and the version must move strictly forward so a captured
+// old manifest can't be replayed to undo a revocation.
+func (a *AuthManager) PublishManifest(m *EncryptionManifest) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	signer, ok := a.trustedDevices[m.SignerDeviceID]
+	if !ok {
+		return errors.New("manifest signer is not a trusted device")
+	}
+	if err := verifyManifestSignature(m, signer.PublicKey); err != nil {
+		return err
+	}
+	if a.manifest != nil && m.Version <= a.manifest.Version {
+		return fmt.Errorf("manifest version %d is not newer than current version %d", m.Version, a.manifest.Version)
+	}
+
+	a.manifest = m
+	if err := a.persistManifestLocked(); err != nil {
+		return fmt.Errorf("publishing manifest: %w", err)
+	}
+	return nil
+}
+
+// Manifest returns the currently published access manifest, if one exists.
+func (a *AuthManager) Manifest() (*EncryptionManifest, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.manifest, a.manifest != nil
+}
+
+// loadManifest reads the JSON sidecar written by persistManifestLocked, if
+// one exists. A missing file just means no manifest has been published yet.
+// The manifest holds only per-device wrapped copies of the vault root key,
+// already opaque ciphertext to the server, so unlike the token store it
+// doesn't need to be sealed at rest.
+func (a *AuthManager) loadManifest() error {
+	if a.manifestStorePath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(a.manifestStorePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var m EncryptionManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("parsing manifest sidecar: %w", err)
+	}
+	a.manifest = &m
+	return nil
+}
+
+// persistManifestLocked writes the current access manifest to
+// a.manifestStorePath. Callers must hold a.mu.
+func (a *AuthManager) persistManifestLocked() error {
+	if a.manifestStorePath == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(a.manifest)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := a.manifestStorePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, a.manifestStorePath)
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultLockTTL is how long an acquired lock survives without being
+// refreshed, unless the caller requests a different TTL.
+const defaultLockTTL = 30 * time.Second
+
+// lockSweepInterval is how often the background goroutine checks for
+// unrefreshed locks to evict, mirroring minio's refresh-locking cleanup.
+const lockSweepInterval = 5 * time.Second
+
+// writeBlockGrace is how long WriteFile/DeleteFile-adjacent callers wait for
+// a conflicting lock to be released before giving up with a conflict error,
+// so a lock that's about to be refreshed or released doesn't fail a write
+// that would have succeeded a moment later.
+const writeBlockGrace = 2 * time.Second
+
+// ErrLockHeldByOther is returned by RefreshLock/ReleaseLock when the caller
+// doesn't hold the lock it's trying to operate on.
+var ErrLockHeldByOther = errors.New("lock is held by another device")
+
+// LockConflictError reports that path is locked by a device other than the
+// caller. The HTTP handlers in this file answer it with 409
+// (acquire/refresh/release); HandleChunkManifest in websocket.go answers a
+// blocked write with 423. SyncManager answers a blocked WebSocket write,
+// delete or move with a "file_locked" message, not an HTTP status, so a
+// blocked delete never yields 423.
+type LockConflictError struct {
+	Path   string
+	Holder string
+}
+
+func (e *LockConflictError) Error() string {
+	return fmt.Sprintf("%s is locked by %s", e.Path, e.Holder)
+}
+
+// FileLock is one path's active lease. cancel is closed on release or
+// expiry so a blocked writer waiting in LockManager.CheckWritable wakes up
+// immediately instead of waiting out the full grace period.
+type FileLock struct {
+	Path        string        `json:"path"`
+	DeviceID    string        `json:"deviceId"`
+	TTL         time.Duration `json:"ttl"`
+	AcquiredAt  time.Time     `json:"acquiredAt"`
+	LastRefresh time.Time     `json:"lastRefresh"`
+	cancel      chan struct{}
+}
+
+func (l *FileLock) expired(now time.Time) bool {
+	return now.Sub(l.LastRefresh) > l.TTL
+}
+
+// LockManager coordinates multi-writer access to vault paths with leased,
+// explicitly-refreshed locks (see AcquireLock/RefreshLock/ReleaseLock). It's
+// the mitigation for concurrent editors on two devices corrupting a large
+// attachment mid-upload, which vector-clock last-write-wins alone doesn't
+// prevent. The active lock table is persisted to a JSON sidecar so a
+// restart doesn't silently drop locks held by a long-running upload.
+type LockManager struct {
+	auth        *AuthManager
+	sidecarPath string
+
+	mu    sync.Mutex
+	locks map[string]*FileLock
+
+	stopSweep chan struct{}
+}
+
+// NewLockManager loads any previously persisted lock table from sidecarPath
+// (dropping entries that already expired while the server was down) and
+// starts the background sweep goroutine. auth resolves the deviceID behind
+// a lock request's bearer token.
+func NewLockManager(auth *AuthManager, sidecarPath string, defaultTTL time.Duration) (*LockManager, error) {
+	lm := &LockManager{
+		auth:        auth,
+		sidecarPath: sidecarPath,
+		locks:       make(map[string]*FileLock),
+		stopSweep:   make(chan struct{}),
+	}
+
+	if err := lm.load(); err != nil {
+		return nil, err
+	}
+
+	go lm.sweepLoop()
+	return lm, nil
+}
+
+// Stop halts the sweep goroutine, e.g. during graceful shutdown.
+func (lm *LockManager) Stop() {
+	close(lm.stopSweep)
+}
+
+func (lm *LockManager) sweepLoop() {
+	ticker := time.NewTicker(lockSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			lm.sweepExpired()
+		case <-lm.stopSweep:
+			return
+		}
+	}
+}
+
+func (lm *LockManager) sweepExpired() {
+	now := time.Now()
+
+	lm.mu.Lock()
+	var evicted bool
+	for path, lock := range lm.locks {
+		if lock.expired(now) {
+			log.Printf("Lock on %s held by %s expired without refresh, releasing", path, lock.DeviceID)
+			close(lock.cancel)
+			delete(lm.locks, path)
+			evicted = true
+		}
+	}
+	lm.mu.Unlock()
+
+	if evicted {
+		if err := lm.persist(); err != nil {
+			log.Printf("Failed to persist lock table after sweep: %v", err)
+		}
+	}
+}
+
+// AcquireLock grants deviceID an exclusive lease on path for ttl (or
+// defaultLockTTL if ttl <= 0). Re-acquiring a lock already held by deviceID
+// just refreshes it. Returns *LockConflictError if someone else holds it.
+func (lm *LockManager) AcquireLock(path, deviceID string, ttl time.Duration) (*FileLock, error) {
+	if ttl <= 0 {
+		ttl = defaultLockTTL
+	}
+
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	now := time.Now()
+	if existing, ok := lm.locks[path]; ok && !existing.expired(now) {
+		if existing.DeviceID != deviceID {
+			return nil, &LockConflictError{Path: path, Holder: existing.DeviceID}
+		}
+		existing.LastRefresh = now
+		existing.TTL = ttl
+		if err := lm.persistLocked(); err != nil {
+			return nil, err
+		}
+		return existing, nil
+	}
+
+	lock := &FileLock{
+		Path:        path,
+		DeviceID:    deviceID,
+		TTL:         ttl,
+		AcquiredAt:  now,
+		LastRefresh: now,
+		cancel:      make(chan struct{}),
+	}
+	lm.locks[path] = lock
+
+	if err := lm.persistLocked(); err != nil {
+		delete(lm.locks, path)
+		return nil, err
+	}
+	return lock, nil
+}
+
+// RefreshLock extends deviceID's existing lock on path. Callers must call
+// this on a timer shorter than the lock's TTL or risk losing it to the
+// sweep goroutine.
+func (lm *LockManager) RefreshLock(path, deviceID string) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	lock, ok := lm.locks[path]
+	if !ok {
+		return fmt.Errorf("no lock held on %s", path)
+	}
+	if lock.DeviceID != deviceID {
+		return ErrLockHeldByOther
+	}
+
+	lock.LastRefresh = time.Now()
+	return lm.persistLocked()
+}
+
+// ReleaseLock drops deviceID's lock on path, e.g. once an upload completes.
+func (lm *LockManager) ReleaseLock(path, deviceID string) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	lock, ok := lm.locks[path]
+	if !ok {
+		return nil // Already unlocked
+	}
+	if lock.DeviceID != deviceID {
+		return ErrLockHeldByOther
+	}
+
+	close(lock.cancel)
+	delete(lm.locks, path)
+	return lm.persistLocked()
+}
+
+// CheckWritable blocks briefly for a lock on path held by a device other
+// than deviceID to be released, then returns *LockConflictError if it's
+// still held. An unlocked path, or one locked by deviceID itself, returns
+// nil immediately. Callers: SyncManager's file_change/file_delete/file_move
+// handlers, block-manifest upload finish and streamed file_upload, and the
+// chunk manifest finalize endpoint.
+func (lm *LockManager) CheckWritable(path, deviceID string) error {
+	lock, blocked := lm.conflictingLock(path, deviceID)
+	if !blocked {
+		return nil
+	}
+
+	select {
+	case <-lock.cancel:
+	case <-time.After(writeBlockGrace):
+	}
+
+	if _, stillBlocked := lm.conflictingLock(path, deviceID); stillBlocked {
+		lm.mu.Lock()
+		holder := ""
+		if l, ok := lm.locks[path]; ok {
+			holder = l.DeviceID
+		}
+		lm.mu.Unlock()
+		return &LockConflictError{Path: path, Holder: holder}
+	}
+	return nil
+}
+
+func (lm *LockManager) conflictingLock(path, deviceID string) (*FileLock, bool) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	lock, ok := lm.locks[path]
+	if !ok || lock.expired(time.Now()) || lock.DeviceID == deviceID {
+		return nil, false
+	}
+	return lock, true
+}
+
+// persistedLock is the JSON sidecar's wire format - FileLock minus its
+// unexported, unserializable cancel channel.
+type persistedLock struct {
+	Path        string        `json:"path"`
+	DeviceID    string        `json:"deviceId"`
+	TTL         time.Duration `json:"ttl"`
+	AcquiredAt  time.Time     `json:"acquiredAt"`
+	LastRefresh time.Time     `json:"lastRefresh"`
+}
+
+// persistLocked writes the current lock table to sidecarPath. Callers must
+// hold lm.mu.
+func (lm *LockManager) persistLocked() error {
+	if lm.sidecarPath == "" {
+		return nil
+	}
+
+	persisted := make([]persistedLock, 0, len(lm.locks))
+	for _, lock := range lm.locks {
+		persisted = append(persisted, persistedLock{
+			Path:        lock.Path,
+			DeviceID:    lock.DeviceID,
+			TTL:         lock.TTL,
+			AcquiredAt:  lock.AcquiredAt,
+			LastRefresh: lock.LastRefresh,
+		})
+	}
+
+	data, err := json.Marshal(persisted)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := lm.sidecarPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, lm.sidecarPath)
+}
+
+func (lm *LockManager) persist() error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	return lm.persistLocked()
+}
+
+// load reads the JSON sidecar written by persistLocked, dropping any lock
+// that already expired while the server was down.
+func (lm *LockManager) load() error {
+	data, err := os.ReadFile(lm.sidecarPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var persisted []persistedLock
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		return fmt.Errorf("parsing lock sidecar: %w", err)
+	}
+
+	now := time.Now()
+	for _, p := range persisted {
+		lock := &FileLock{
+			Path:        p.Path,
+			DeviceID:    p.DeviceID,
+			TTL:         p.TTL,
+			AcquiredAt:  p.AcquiredAt,
+			LastRefresh: p.LastRefresh,
+			cancel:      make(chan struct{}),
+		}
+		if lock.expired(now) {
+			continue
+		}
+		lm.locks[lock.Path] = lock
+	}
+	return nil
+}
+
+// HTTP endpoints. Lock ownership is tied to the caller's authenticated
+// device identity (resolved via AuthManager.ValidateToken), never a
+// client-supplied device_id, so one device can't release or hijack another
+// device's lock just by naming it in the request body.
+
+type lockRequest struct {
+	Path       string `json:"path"`
+	TTLSeconds int    `json:"ttl_seconds,omitempty"`
+}
+
+// HandleAcquireLock handles POST /api/locks/acquire.
+func (lm *LockManager) HandleAcquireLock(w http.ResponseWriter, r *http.Request) {
+	deviceID, ok := lm.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	var req lockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+		http.Error(w, "path is required", http.StatusBadRequest)
+		return
+	}
+
+	lock, err := lm.AcquireLock(req.Path, deviceID, time.Duration(req.TTLSeconds)*time.Second)
+	if err != nil {
+		lm.writeLockError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lock)
+}
+
+// HandleRefreshLock handles POST /api/locks/refresh.
+func (lm *LockManager) HandleRefreshLock(w http.ResponseWriter, r *http.Request) {
+	deviceID, ok := lm.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	var req lockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+		http.Error(w, "path is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := lm.RefreshLock(req.Path, deviceID); err != nil {
+		lm.writeLockError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"path": req.Path, "status": "refreshed"})
+}
+
+// HandleReleaseLock handles POST /api/locks/release.
+func (lm *LockManager) HandleReleaseLock(w http.ResponseWriter, r *http.Request) {
+	deviceID, ok := lm.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	var req lockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+		http.Error(w, "path is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := lm.ReleaseLock(req.Path, deviceID); err != nil {
+		lm.writeLockError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"path": req.Path, "status": "released"})
+}
+
+func (lm *LockManager) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return "", false
+	}
+	deviceID, _, ok := lm.auth.Authenticate(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+	return deviceID, true
+}
+
+func (lm *LockManager) writeLockError(w http.ResponseWriter, err error) {
+	var conflict *LockConflictError
+	if errors.As(err, &conflict) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": conflict.Error(), "holder": conflict.Holder})
+		return
+	}
+	if errors.Is(err, ErrLockHeldByOther) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
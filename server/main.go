@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -8,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 )
 
@@ -26,25 +29,55 @@ func main() {
 		log.Fatal("VAULT_SYNC_TOKEN environment variable is required")
 	}
 
-	// Initialize storage
-	storage, err := NewStorage(config.Storage.Path, config.Sync.MaxFileSizeMB)
+	// Initialize storage backend (local filesystem, S3, or WebDAV - see
+	// storagebackend.go)
+	storage, err := NewStorageBackend(config.Storage, config.Sync.MaxFileSizeMB)
 	if err != nil {
 		log.Fatalf("Failed to initialize storage: %v", err)
 	}
-	log.Printf("Storage initialized: %s", config.Storage.Path)
-
-	// Initialize auth
-	auth := NewAuthManager(config.Auth.MasterToken)
+	backendName := config.Storage.Type
+	if backendName == "" {
+		backendName = "local"
+	}
+	log.Printf("Storage initialized: %s backend", backendName)
+
+	// Initialize auth. Device tokens persist to an encrypted sidecar under
+	// storage.Path so a restart doesn't silently revoke every device (see
+	// tokenstore.go). The published access manifest persists alongside them
+	// so a restart doesn't drop every device's wrapped vault root key (see
+	// encryption.go).
+	tokenStorePath := filepath.Join(config.Storage.Path, "tokens.json.enc")
+	manifestStorePath := filepath.Join(config.Storage.Path, "manifest.json")
+	auth, err := NewAuthManager(config.Auth.MasterToken, tokenStorePath, manifestStorePath)
+	if err != nil {
+		log.Fatalf("Failed to initialize auth: %v", err)
+	}
 
-	// Initialize hub
-	hub := NewHub()
+	// Initialize hub. Undelivered messages for a disconnected or backed-up
+	// device are journaled under storage/queue and redelivered with
+	// exponential backoff on reconnect.
+	queueDir := filepath.Join(config.Storage.Path, "queue")
+	hub, err := NewHub(config.Sync.MaxInFlightMB, config.Sync.PerDeviceMaxRequestKiB, queueDir, config.Retry)
+	if err != nil {
+		log.Fatalf("Failed to initialize hub: %v", err)
+	}
 	go hub.Run()
 
+	// Initialize lock manager. Locks are leased with a refresh, not held
+	// forever, so a crashed client can't wedge a path shut; the sidecar
+	// under storage.Path means a restart doesn't silently drop a lock held
+	// by a long-running upload.
+	lockSidecar := filepath.Join(config.Storage.Path, "locks.json")
+	locks, err := NewLockManager(auth, lockSidecar, defaultLockTTL)
+	if err != nil {
+		log.Fatalf("Failed to initialize lock manager: %v", err)
+	}
+
 	// Initialize sync manager
-	syncManager := NewSyncManager(storage, hub, config.Sync.ConflictResolution)
+	syncManager := NewSyncManager(storage, hub, config.Sync.ConflictResolution, locks)
 
 	// Initialize WebSocket handler
-	wsHandler := NewWSHandler(hub, syncManager, auth, storage)
+	wsHandler := NewWSHandler(hub, syncManager, auth, storage, locks, config.Server.TLS.Enabled, config.Server.FaultInjection)
 
 	// Setup HTTP routes
 	mux := http.NewServeMux()
@@ -82,13 +115,50 @@ func main() {
 
 	// Token management
 	mux.HandleFunc("/api/token", auth.HandleGenerateToken)
+	mux.HandleFunc("/api/token/rotate", auth.HandleRotateToken)
 	mux.HandleFunc("/api/devices", auth.HandleListDevices)
 
+	// Device identity: crypto handshake challenge + operator approval queue
+	mux.HandleFunc("/api/devices/challenge", auth.HandleDeviceChallenge)
+	mux.HandleFunc("/api/devices/pending", auth.HandlePendingDevices)
+	mux.HandleFunc("/api/devices/approve", auth.HandleApproveDevice)
+	mux.HandleFunc("/api/devices/", wsHandler.HandleDeviceLimits)
+
+	// E2E encryption: device key enrollment + access manifest publish/fetch
+	mux.HandleFunc("/api/encryption/keys", auth.HandleEnrollEncryptionKey)
+	mux.HandleFunc("/api/encryption/manifest", auth.HandleManifest)
+
+	// Content-defined chunked uploads with server-side dedup (see
+	// chunkstore.go): pre-upload "have these chunks?" check, per-chunk
+	// upload, and manifest finalization.
+	mux.HandleFunc("/api/chunks/have", wsHandler.HandleChunksHave)
+	mux.HandleFunc("/api/chunks/manifest", wsHandler.HandleChunkManifest)
+	mux.HandleFunc("/api/chunks/", wsHandler.HandleChunkUpload)
+
+	// Leased file locks (see locks.go): acquire/refresh/release coordinate
+	// multi-writer access to a path so two devices editing a large
+	// attachment concurrently don't interleave writes.
+	mux.HandleFunc("/api/locks/acquire", locks.HandleAcquireLock)
+	mux.HandleFunc("/api/locks/refresh", locks.HandleRefreshLock)
+	mux.HandleFunc("/api/locks/release", locks.HandleReleaseLock)
+
+	// Debug: force-close a connected device's socket to exercise the
+	// reconnect+resync path in integration tests. Pair with
+	// server.fault_injection in config for unstable-network testing.
+	mux.HandleFunc("/api/debug/restart-client/", wsHandler.HandleDebugRestartClient)
+
+	// Structured JSON access log (see accesslog.go); no-op if
+	// server.access_log.path is unset.
+	accessLog, err := NewAccessLogHandler(logMiddleware(mux), auth, config.Server.AccessLog)
+	if err != nil {
+		log.Fatalf("Failed to open access log: %v", err)
+	}
+
 	// Create server
 	addr := fmt.Sprintf(":%d", config.Server.Port)
 	server := &http.Server{
 		Addr:    addr,
-		Handler: logMiddleware(mux),
+		Handler: accessLog,
 	}
 
 	// Graceful shutdown
@@ -98,10 +168,43 @@ func main() {
 		<-sigChan
 		log.Println("Shutting down...")
 		server.Close()
+		accessLog.Close()
+		locks.Stop()
+	}()
+
+	// SIGHUP reopens the access log file so it cooperates with an external
+	// logrotate instead of continuing to write to a renamed file.
+	go func() {
+		hupChan := make(chan os.Signal, 1)
+		signal.Notify(hupChan, syscall.SIGHUP)
+		for range hupChan {
+			log.Println("Received SIGHUP, reopening access log")
+			if err := accessLog.Reopen(); err != nil {
+				log.Printf("Failed to reopen access log: %v", err)
+			}
+		}
 	}()
 
 	// Start server
 	if config.Server.TLS.Enabled {
+		if config.Server.TLS.ClientCA != "" {
+			caCert, err := os.ReadFile(config.Server.TLS.ClientCA)
+			if err != nil {
+				log.Fatalf("Failed to read client CA: %v", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(caCert) {
+				log.Fatalf("Failed to parse client CA certificate")
+			}
+			// VerifyClientCertIfGiven (not Require) so devices without a
+			// client cert can still authenticate to /ws via the signed
+			// challenge nonce path.
+			server.TLSConfig = &tls.Config{
+				ClientCAs:  pool,
+				ClientAuth: tls.VerifyClientCertIfGiven,
+			}
+		}
+
 		log.Printf("Starting TLS server on %s", addr)
 		err = server.ListenAndServeTLS(config.Server.TLS.Cert, config.Server.TLS.Key)
 	} else {
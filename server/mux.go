@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// MuxFlag marks what role a frame plays within its stream.
+type MuxFlag uint8
+
+const (
+	FlagOpen MuxFlag = iota + 1
+	FlagData
+	FlagEnd
+	FlagCancel
+	FlagError
+)
+
+// streamChunkSize is the target size for DATA frames carrying file content.
+const streamChunkSize = 256 * 1024
+
+// Frame is one multiplexed unit on the wire, layered on top of the existing
+// WebSocket text messages. StreamID 0 is reserved for the legacy
+// one-message-one-file JSON envelope (SyncMessage/ServerMessage), which
+// keeps working unchanged as a fallback.
+type Frame struct {
+	StreamID uint32  `json:"streamId"`
+	Flags    MuxFlag `json:"flags"`
+	Type     string  `json:"type,omitempty"` // Only set on OPEN
+	Payload  []byte  `json:"payload,omitempty"`
+}
+
+// decodeFrame reports whether raw is a mux Frame (as opposed to a legacy
+// SyncMessage/ServerMessage envelope) by checking for a non-zero streamId.
+func decodeFrame(raw []byte) (Frame, bool) {
+	var probe struct {
+		StreamID uint32 `json:"streamId"`
+	}
+	if err := json.Unmarshal(raw, &probe); err != nil || probe.StreamID == 0 {
+		return Frame{}, false
+	}
+
+	var frame Frame
+	if err := json.Unmarshal(raw, &frame); err != nil {
+		return Frame{}, false
+	}
+	return frame, true
+}
+
+// SingleRequestHandler answers a request/response exchange in one round
+// trip — used for small ops like ping or metadata lookups.
+type SingleRequestHandler func(initial []byte) ([]byte, error)
+
+// StreamRequestHandler answers a request that spans multiple DATA frames —
+// used for chunked file upload/download. It receives the OPEN frame's
+// payload and a channel of subsequent DATA chunks (closed once the peer
+// sends END, CANCELs, or disconnects), and returns a channel of response
+// chunks to stream back to the peer (closed when the response is complete).
+// `in` closing is not by itself proof of a clean upload: aborted reports
+// whether the close was a real END (false) or an abort - CANCEL,
+// peer-disconnect, or the stream being failed out from under a slow
+// consumer (true) - so a handler committing incremental state (e.g.
+// HandleStreamUpload) can tell a finished transfer from a truncated one.
+type StreamRequestHandler func(initial []byte, in <-chan []byte, aborted func() bool) (<-chan []byte, error)
+
+// MuxServer demuxes inbound frames from a single connection and dispatches
+// them to handlers registered by request type, writing framed responses
+// back out through a caller-supplied send function. One MuxServer exists
+// per connected Client.
+type MuxServer struct {
+	send func(Frame) error
+
+	singleHandlers map[string]SingleRequestHandler
+	streamHandlers map[string]StreamRequestHandler
+
+	mu      sync.Mutex
+	streams map[uint32]*serverStream
+}
+
+type serverStream struct {
+	in chan []byte
+
+	// closeMu serializes handleData's send against closeStream's close, so
+	// a frame arriving just as the stream is torn down can never be sent on
+	// an already-closed channel. It also guards aborted, so a handler
+	// reading it via isAborted always sees the value that matches whether
+	// `in` is closed yet.
+	closeMu sync.Mutex
+	closed  bool
+	aborted bool
+}
+
+// isAborted reports whether the stream was torn down by an abort (CANCEL,
+// disconnect, or a failed slow-consumer) rather than a clean END. Safe to
+// call concurrently with the close path.
+func (s *serverStream) isAborted() bool {
+	s.closeMu.Lock()
+	defer s.closeMu.Unlock()
+	return s.aborted
+}
+
+func NewMuxServer(send func(Frame) error) *MuxServer {
+	return &MuxServer{
+		send:           send,
+		singleHandlers: make(map[string]SingleRequestHandler),
+		streamHandlers: make(map[string]StreamRequestHandler),
+		streams:        make(map[uint32]*serverStream),
+	}
+}
+
+// SingleRequest registers a handler for a one-shot request type.
+func (m *MuxServer) SingleRequest(reqType string, handler SingleRequestHandler) {
+	m.singleHandlers[reqType] = handler
+}
+
+// StreamRequest registers a handler for a chunked request type.
+func (m *MuxServer) StreamRequest(reqType string, handler StreamRequestHandler) {
+	m.streamHandlers[reqType] = handler
+}
+
+// HandleFrame processes one inbound frame. Call for every message whose
+// StreamID is non-zero.
+func (m *MuxServer) HandleFrame(f Frame) {
+	switch f.Flags {
+	case FlagOpen:
+		m.handleOpen(f)
+	case FlagData:
+		m.handleData(f)
+	case FlagEnd:
+		m.handleEnd(f)
+	case FlagCancel:
+		m.closeStream(f.StreamID)
+	}
+}
+
+func (m *MuxServer) handleOpen(f Frame) {
+	if handler, ok := m.singleHandlers[f.Type]; ok {
+		go func() {
+			resp, err := handler(f.Payload)
+			if err != nil {
+				m.send(Frame{StreamID: f.StreamID, Flags: FlagError, Payload: []byte(err.Error())})
+				return
+			}
+			m.send(Frame{StreamID: f.StreamID, Flags: FlagData, Payload: resp})
+			m.send(Frame{StreamID: f.StreamID, Flags: FlagEnd})
+		}()
+		return
+	}
+
+	if handler, ok := m.streamHandlers[f.Type]; ok {
+		in := make(chan []byte, 8)
+		stream := &serverStream{in: in}
+		m.mu.Lock()
+		m.streams[f.StreamID] = stream
+		m.mu.Unlock()
+
+		go func() {
+			out, err := handler(f.Payload, in, stream.isAborted)
+			if err != nil {
+				m.send(Frame{StreamID: f.StreamID, Flags: FlagError, Payload: []byte(err.Error())})
+				m.closeStream(f.StreamID)
+				return
+			}
+			for chunk := range out {
+				if sendErr := m.send(Frame{StreamID: f.StreamID, Flags: FlagData, Payload: chunk}); sendErr != nil {
+					m.closeStream(f.StreamID)
+					return
+				}
+			}
+			m.send(Frame{StreamID: f.StreamID, Flags: FlagEnd})
+			m.closeStream(f.StreamID)
+		}()
+		return
+	}
+
+	m.send(Frame{StreamID: f.StreamID, Flags: FlagError, Payload: []byte(fmt.Sprintf("unknown request type %q", f.Type))})
+}
+
+func (m *MuxServer) handleData(f Frame) {
+	m.mu.Lock()
+	stream, ok := m.streams[f.StreamID]
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	stream.closeMu.Lock()
+	defer stream.closeMu.Unlock()
+	if stream.closed {
+		return
+	}
+
+	select {
+	case stream.in <- f.Payload:
+	default:
+		// The consumer (e.g. a file write to a slow disk) isn't keeping up.
+		// Dropping the frame here would silently truncate whatever is being
+		// streamed, so fail the stream instead - the peer sees an ERROR and
+		// can retry, rather than ending up with corrupt content.
+		m.send(Frame{StreamID: f.StreamID, Flags: FlagError, Payload: []byte("stream buffer full; consumer too slow")})
+		m.removeAndClose(f.StreamID, stream, true)
+	}
+}
+
+func (m *MuxServer) handleEnd(f Frame) {
+	m.mu.Lock()
+	stream, ok := m.streams[f.StreamID]
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	stream.closeMu.Lock()
+	defer stream.closeMu.Unlock()
+	if stream.closed {
+		return
+	}
+	m.removeAndClose(f.StreamID, stream, false)
+}
+
+// closeStream tears down a stream from outside handleData/handleEnd, e.g. on
+// a CANCEL frame or when a handler fails. It takes stream.closeMu itself
+// rather than assuming the caller already holds it.
+func (m *MuxServer) closeStream(streamID uint32) {
+	m.mu.Lock()
+	stream, ok := m.streams[streamID]
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	stream.closeMu.Lock()
+	defer stream.closeMu.Unlock()
+	if stream.closed {
+		return
+	}
+	m.removeAndClose(streamID, stream, true)
+}
+
+// removeAndClose deletes the stream from the registry and closes its `in`
+// channel, recording whether the teardown was a clean END (aborted=false) or
+// not (aborted=true) so a handler blocked on `for range in` can tell which
+// happened via serverStream.isAborted. Callers must already hold
+// stream.closeMu and have checked stream.closed, so this is the only place
+// that ever closes `in` - no sender can race it.
+func (m *MuxServer) removeAndClose(streamID uint32, stream *serverStream, aborted bool) {
+	m.mu.Lock()
+	delete(m.streams, streamID)
+	m.mu.Unlock()
+
+	stream.closed = true
+	stream.aborted = aborted
+	close(stream.in)
+}
+
+// CloseAll aborts every in-flight stream, e.g. because the underlying
+// connection died. Handlers blocked reading from their `in` channel see it
+// close, just as if the peer had sent END, but isAborted reports true so
+// they don't mistake the disconnect for a completed upload.
+func (m *MuxServer) CloseAll() {
+	m.mu.Lock()
+	streams := m.streams
+	m.streams = make(map[uint32]*serverStream)
+	m.mu.Unlock()
+
+	for _, stream := range streams {
+		stream.closeMu.Lock()
+		if !stream.closed {
+			stream.closed = true
+			stream.aborted = true
+			close(stream.in)
+		}
+		stream.closeMu.Unlock()
+	}
+}
+
+// MuxClient is the initiating side of the mux protocol: it opens streams,
+// sends request/upload frames, and demuxes responses back to the caller.
+// The server doesn't currently originate requests to devices, but this
+// mirrors MuxServer so a future server-initiated pull (e.g. re-requesting a
+// file after a fault-injected disconnect) doesn't need a new wire format.
+type MuxClient struct {
+	send func(Frame) error
+
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan Frame
+}
+
+func NewMuxClient(send func(Frame) error) *MuxClient {
+	return &MuxClient{send: send, pending: make(map[uint32]chan Frame)}
+}
+
+// Request opens a stream, sends the initial OPEN frame, and returns a
+// channel of response frames (DATA/END/ERROR) for the caller to consume.
+func (c *MuxClient) Request(reqType string, initial []byte) (uint32, <-chan Frame, error) {
+	c.mu.Lock()
+	c.nextID++
+	streamID := c.nextID
+	respCh := make(chan Frame, 8)
+	c.pending[streamID] = respCh
+	c.mu.Unlock()
+
+	if err := c.send(Frame{StreamID: streamID, Flags: FlagOpen, Type: reqType, Payload: initial}); err != nil {
+		c.mu.Lock()
+		delete(c.pending, streamID)
+		c.mu.Unlock()
+		return 0, nil, err
+	}
+	return streamID, respCh, nil
+}
+
+// SendChunk streams one more DATA frame for an already-open stream.
+func (c *MuxClient) SendChunk(streamID uint32, data []byte) error {
+	return c.send(Frame{StreamID: streamID, Flags: FlagData, Payload: data})
+}
+
+// EndStream signals that an upload is complete.
+func (c *MuxClient) EndStream(streamID uint32) error {
+	return c.send(Frame{StreamID: streamID, Flags: FlagEnd})
+}
+
+// CancelStream aborts a stream, e.g. when the peer disappears mid-transfer.
+func (c *MuxClient) CancelStream(streamID uint32) error {
+	return c.send(Frame{StreamID: streamID, Flags: FlagCancel})
+}
+
+// HandleFrame routes an inbound response frame to the waiting caller.
+func (c *MuxClient) HandleFrame(f Frame) {
+	c.mu.Lock()
+	ch, ok := c.pending[f.StreamID]
+	if ok && (f.Flags == FlagEnd || f.Flags == FlagError) {
+		delete(c.pending, f.StreamID)
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	ch <- f
+	if f.Flags == FlagEnd || f.Flags == FlagError {
+		close(ch)
+	}
+}
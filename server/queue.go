@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// QueuedMessage is a marshaled ServerMessage that couldn't be delivered
+// immediately, persisted so a momentarily slow or disconnected device
+// doesn't permanently miss a change.
+type QueuedMessage struct {
+	Path     string          `json:"path,omitempty"`
+	Message  json.RawMessage `json:"message"`
+	QueuedAt int64           `json:"queuedAt"`
+}
+
+// OutboundQueue persists undelivered messages per device to
+// <dir>/<deviceID>.json. A message tied to a file path supersedes any
+// earlier queued message for that same path, since only the latest state
+// is worth redelivering.
+type OutboundQueue struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func NewOutboundQueue(dir string) (*OutboundQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &OutboundQueue{dir: dir}, nil
+}
+
+func (q *OutboundQueue) path(deviceID string) string {
+	return filepath.Join(q.dir, deviceID+".json")
+}
+
+// Enqueue appends msg to deviceID's journal, dropping any previously queued
+// entry for the same path.
+func (q *OutboundQueue) Enqueue(deviceID string, msg QueuedMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries, err := q.load(deviceID)
+	if err != nil {
+		return err
+	}
+
+	if msg.Path != "" {
+		kept := entries[:0]
+		for _, e := range entries {
+			if e.Path != msg.Path {
+				kept = append(kept, e)
+			}
+		}
+		entries = kept
+	}
+
+	entries = append(entries, msg)
+	return q.save(deviceID, entries)
+}
+
+// Drain returns and clears every message queued for deviceID.
+func (q *OutboundQueue) Drain(deviceID string) ([]QueuedMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries, err := q.load(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(q.path(deviceID)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (q *OutboundQueue) load(deviceID string) ([]QueuedMessage, error) {
+	data, err := os.ReadFile(q.path(deviceID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var entries []QueuedMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (q *OutboundQueue) save(deviceID string, entries []QueuedMessage) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(q.path(deviceID), data, 0644)
+}
+
+// backoffDuration returns how long to wait before the given (0-indexed)
+// retry attempt under policy, capped at MaxBackoffMs.
+func backoffDuration(policy RetryPolicy, attempt int) time.Duration {
+	initial := time.Duration(policy.InitialBackoffMs) * time.Millisecond
+	max := time.Duration(policy.MaxBackoffMs) * time.Millisecond
+
+	wait := float64(initial) * math.Pow(policy.Multiplier, float64(attempt))
+	if wait > float64(max) {
+		wait = float64(max)
+	}
+	return time.Duration(wait)
+}
+
+// DrainWithRetry redelivers every message queued for deviceID via send,
+// retrying each one with exponential backoff up to policy.MaxAttempts.
+// Entries still failing after every attempt are dropped - the device will
+// pick up the current state on its next full sync regardless.
+func (q *OutboundQueue) DrainWithRetry(deviceID string, policy RetryPolicy, send func(json.RawMessage) error) {
+	entries, err := q.Drain(deviceID)
+	if err != nil {
+		log.Printf("Failed to drain outbound queue for %s: %v", deviceID, err)
+		return
+	}
+	if len(entries) == 0 {
+		return
+	}
+
+	log.Printf("Redelivering %d queued message(s) to %s", len(entries), deviceID)
+
+	for _, entry := range entries {
+		var lastErr error
+		for attempt := 0; attempt < policy.MaxAttempts; attempt++ {
+			if attempt > 0 {
+				time.Sleep(backoffDuration(policy, attempt-1))
+			}
+			if lastErr = send(entry.Message); lastErr == nil {
+				break
+			}
+		}
+		if lastErr != nil {
+			log.Printf("Giving up on a queued message for %s after %d attempts: %v", deviceID, policy.MaxAttempts, lastErr)
+		}
+	}
+}
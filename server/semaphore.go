@@ -0,0 +1,67 @@
+package main
+
+import "sync"
+
+// byteSemaphore bounds how many bytes of in-flight message data are allowed
+// at once. take blocks until enough capacity is available; give releases it
+// back. Used to give the hub real backpressure instead of silently dropping
+// messages when a client (or the server as a whole) is flooded.
+type byteSemaphore struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	available int64
+	max       int64
+}
+
+func newByteSemaphore(max int64) *byteSemaphore {
+	s := &byteSemaphore{available: max, max: max}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// take blocks until n bytes are available and reserves them. Requests
+// larger than the semaphore's max are clamped so they can still proceed.
+func (s *byteSemaphore) take(n int64) {
+	if n > s.max {
+		n = s.max
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for n > s.available {
+		s.cond.Wait()
+	}
+	s.available -= n
+}
+
+// give releases n bytes back to the pool.
+func (s *byteSemaphore) give(n int64) {
+	if n > s.max {
+		n = s.max
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.available += n
+	if s.available > s.max {
+		s.available = s.max
+	}
+	s.cond.Broadcast()
+}
+
+// setMax adjusts the semaphore's capacity, preserving however much is
+// currently in use.
+func (s *byteSemaphore) setMax(max int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.available += max - s.max
+	s.max = max
+	if s.available < 0 {
+		s.available = 0
+	}
+	if s.available > s.max {
+		s.available = s.max
+	}
+	s.cond.Broadcast()
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"hash"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -16,8 +19,99 @@ var (
 	ErrPathTraversal = errors.New("path traversal detected")
 	ErrFileTooLarge  = errors.New("file too large")
 	ErrInvalidPath   = errors.New("invalid file path")
+	ErrBlockNotFound = errors.New("block not found")
 )
 
+// blocksDirName and manifestsDirName are reserved top-level directories used
+// by the block store; they're excluded from ListFiles/rebuildHashCache so
+// they never show up as vault content.
+const (
+	blocksDirName    = "blocks"
+	manifestsDirName = ".manifests"
+)
+
+// blockSizeLadder mirrors Syncthing's fixed block sizes: the smallest size is
+// picked such that a file doesn't explode into more than ~2000 blocks.
+var blockSizeLadder = []int64{
+	128 * 1024,
+	256 * 1024,
+	512 * 1024,
+	1024 * 1024,
+	2 * 1024 * 1024,
+	4 * 1024 * 1024,
+	8 * 1024 * 1024,
+	16 * 1024 * 1024,
+}
+
+// zeroBlockHashes holds the precomputed SHA-256 of an all-zero block for
+// each ladder size, so sparse regions never need to be stored or transferred.
+var zeroBlockHashes = computeZeroBlockHashes()
+
+func computeZeroBlockHashes() map[int64]string {
+	hashes := make(map[int64]string, len(blockSizeLadder))
+	zero := make([]byte, blockSizeLadder[len(blockSizeLadder)-1])
+	for _, size := range blockSizeLadder {
+		sum := sha256.Sum256(zero[:size])
+		hashes[size] = hex.EncodeToString(sum[:])
+	}
+	return hashes
+}
+
+func isZeroBlockHash(size int64, hash string) bool {
+	return zeroBlockHashes[size] == hash
+}
+
+// chooseBlockSize picks the smallest ladder size keeping the block count
+// under ~2000, so small files stay small and huge files don't explode.
+func chooseBlockSize(fileSize int64) int64 {
+	for _, size := range blockSizeLadder {
+		if fileSize/size <= 2000 {
+			return size
+		}
+	}
+	return blockSizeLadder[len(blockSizeLadder)-1]
+}
+
+// splitIntoBlocks divides content into fixed-size blocks (the last one may
+// be shorter) and hashes each one with SHA-256.
+func splitIntoBlocks(content []byte, blockSize int64) []BlockInfo {
+	if len(content) == 0 {
+		return nil
+	}
+
+	var blocks []BlockInfo
+	total := int64(len(content))
+	for offset := int64(0); offset < total; offset += blockSize {
+		size := blockSize
+		if offset+size > total {
+			size = total - offset
+		}
+		chunk := content[offset : offset+size]
+		sum := sha256.Sum256(chunk)
+		blocks = append(blocks, BlockInfo{
+			Offset: offset,
+			Size:   size,
+			Hash:   hex.EncodeToString(sum[:]),
+		})
+	}
+	return blocks
+}
+
+// buildManifest computes a FileManifest for content as it would be split for
+// block-based delta sync.
+func buildManifest(path string, content []byte, mtime int64) *FileManifest {
+	blockSize := chooseBlockSize(int64(len(content)))
+	totalHash := sha256.Sum256(content)
+
+	return &FileManifest{
+		Path:      path,
+		MTime:     mtime,
+		TotalHash: hex.EncodeToString(totalHash[:]),
+		BlockSize: blockSize,
+		Blocks:    splitIntoBlocks(content, blockSize),
+	}
+}
+
 type Storage struct {
 	basePath      string
 	maxFileSizeMB int
@@ -42,6 +136,23 @@ type Tombstone struct {
 	TTL         int64             `json:"ttl"`
 }
 
+// Compile-time checks that Storage satisfies the interfaces the sync layer
+// relies on.
+var (
+	_ StorageBackend  = (*Storage)(nil)
+	_ BlockStore      = (*Storage)(nil)
+	_ StreamableStore = (*Storage)(nil)
+)
+
+func init() {
+	RegisterBackend("local", func(cfg StorageConfig, maxFileSizeMB int) (StorageBackend, error) {
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("storage.path is required for the local backend")
+		}
+		return NewStorage(cfg.Path, maxFileSizeMB)
+	})
+}
+
 func NewStorage(basePath string, maxFileSizeMB int) (*Storage, error) {
 	absPath, err := filepath.Abs(basePath)
 	if err != nil {
@@ -132,6 +243,107 @@ func (s *Storage) WriteFile(path string, content []byte, mtime int64) error {
 	return nil
 }
 
+// StreamWriter supports incremental writes for chunked/streamed uploads.
+// Content lands in a temp file alongside the destination and is only
+// renamed into place (and hashed) once the transfer completes, so a
+// mid-transfer disconnect never leaves a half-written file visible.
+type StreamWriter struct {
+	storage  *Storage
+	path     string
+	fullPath string
+	tmpPath  string
+	file     *os.File
+	hasher   hash.Hash
+	written  int64
+	maxSize  int64
+}
+
+// OpenWriteStream begins a streamed write to path.
+func (s *Storage) OpenWriteStream(path string) (*StreamWriter, error) {
+	fullPath, err := s.validatePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(fullPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	tmpPath := fmt.Sprintf("%s.upload-%d", fullPath, time.Now().UnixNano())
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StreamWriter{
+		storage:  s,
+		path:     path,
+		fullPath: fullPath,
+		tmpPath:  tmpPath,
+		file:     file,
+		hasher:   sha256.New(),
+		maxSize:  int64(s.maxFileSizeMB) * 1024 * 1024,
+	}, nil
+}
+
+// Write appends one more chunk, enforcing the same size limit as WriteFile.
+func (w *StreamWriter) Write(chunk []byte) error {
+	w.written += int64(len(chunk))
+	if w.written > w.maxSize {
+		w.Abort()
+		return ErrFileTooLarge
+	}
+
+	if _, err := w.file.Write(chunk); err != nil {
+		return err
+	}
+	w.hasher.Write(chunk)
+	return nil
+}
+
+// Sum returns the hex-encoded SHA-256 of the bytes written so far, without
+// finalizing the stream - lets a caller verify the reconstructed content
+// against an expected hash before deciding to Finish or Abort.
+func (w *StreamWriter) Sum() string {
+	return hex.EncodeToString(w.hasher.Sum(nil))
+}
+
+// Abort discards a partially-written stream, e.g. because the peer
+// disconnected mid-transfer.
+func (w *StreamWriter) Abort() {
+	w.file.Close()
+	os.Remove(w.tmpPath)
+}
+
+// Finish atomically publishes the stream to its final path and updates the
+// hash cache from the incrementally-computed SHA-256.
+func (w *StreamWriter) Finish(mtime int64) error {
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.tmpPath)
+		return err
+	}
+
+	if err := os.Rename(w.tmpPath, w.fullPath); err != nil {
+		os.Remove(w.tmpPath)
+		return err
+	}
+
+	if mtime > 0 {
+		modTime := time.Unix(0, mtime*int64(time.Millisecond))
+		if err := os.Chtimes(w.fullPath, modTime, modTime); err != nil {
+			// Non-fatal error, just log it
+		}
+	}
+
+	hash := hex.EncodeToString(w.hasher.Sum(nil))
+	w.storage.mu.Lock()
+	w.storage.hashes[w.path] = hash
+	w.storage.mu.Unlock()
+
+	return nil
+}
+
 func (s *Storage) ReadFile(path string) ([]byte, error) {
 	fullPath, err := s.validatePath(path)
 	if err != nil {
@@ -205,6 +417,10 @@ func (s *Storage) ListFiles() ([]*FileInfo, error) {
 			if strings.HasPrefix(d.Name(), ".") && d.Name() != "." {
 				return filepath.SkipDir
 			}
+			// Skip the reserved block store
+			if d.Name() == blocksDirName {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
@@ -258,6 +474,9 @@ func (s *Storage) rebuildHashCache() error {
 			if strings.HasPrefix(d.Name(), ".") && d.Name() != "." {
 				return filepath.SkipDir
 			}
+			if d.Name() == blocksDirName {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
@@ -356,3 +575,160 @@ func (s *Storage) CleanupExpiredTombstones() int {
 
 	return count
 }
+
+// Content-addressed block store, used for block-based delta sync.
+
+func (s *Storage) blockPath(hash string) (string, error) {
+	if len(hash) < 4 {
+		return "", ErrInvalidPath
+	}
+	return filepath.Join(s.basePath, blocksDirName, hash[0:2], hash[2:4], hash), nil
+}
+
+// HasBlock reports whether a block with the given hash is already stored.
+func (s *Storage) HasBlock(hash string) bool {
+	path, err := s.blockPath(hash)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// WriteBlock stores a block under its content hash, skipping the write if
+// it's already present.
+func (s *Storage) WriteBlock(hash string, data []byte) error {
+	path, err := s.blockPath(hash)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		return nil // Already have this block
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
+
+// ReadBlock reads a previously stored block by hash.
+func (s *Storage) ReadBlock(hash string) ([]byte, error) {
+	path, err := s.blockPath(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrBlockNotFound
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// ReconstructFromManifest rebuilds a file's content from its block manifest,
+// filling in skipped all-zero blocks without touching the block store.
+func (s *Storage) ReconstructFromManifest(m *FileManifest) ([]byte, error) {
+	var size int64
+	for _, b := range m.Blocks {
+		if end := b.Offset + b.Size; end > size {
+			size = end
+		}
+	}
+
+	content := make([]byte, size)
+	for _, b := range m.Blocks {
+		if isZeroBlockHash(b.Size, b.Hash) {
+			continue // Already zeroed
+		}
+		data, err := s.ReadBlock(b.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("block %s for %s: %w", b.Hash, m.Path, err)
+		}
+		copy(content[b.Offset:b.Offset+b.Size], data)
+	}
+	return content, nil
+}
+
+// Manifest persistence, one JSON sidecar per logical path.
+
+func (s *Storage) manifestPath(path string) (string, error) {
+	fullPath, err := s.validatePath(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(s.basePath, fullPath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.basePath, manifestsDirName, rel+".json"), nil
+}
+
+// SaveManifest persists path's block manifest so future uploads can be
+// diffed against it.
+func (s *Storage) SaveManifest(path string, m *FileManifest) error {
+	manifestPath, err := s.manifestPath(path)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(manifestPath), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(manifestPath, data, 0644)
+}
+
+// GetManifest loads the stored block manifest for path, if any.
+func (s *Storage) GetManifest(path string) (*FileManifest, bool) {
+	manifestPath, err := s.manifestPath(path)
+	if err != nil {
+		return nil, false
+	}
+
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, false
+	}
+
+	var m FileManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, false
+	}
+	return &m, true
+}
+
+// ListManifests returns every stored block manifest, used to seed full sync
+// for peers that support block-based delta sync.
+func (s *Storage) ListManifests() []*FileManifest {
+	var manifests []*FileManifest
+
+	root := filepath.Join(s.basePath, manifestsDirName)
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		var m FileManifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil
+		}
+		manifests = append(manifests, &m)
+		return nil
+	})
+
+	return manifests
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MemoryBackend is an in-memory StorageBackend, useful for local
+// development or CI where persisting to disk or a real object store isn't
+// necessary. Nothing it stores survives a restart.
+type MemoryBackend struct {
+	mu         sync.RWMutex
+	files      map[string][]byte
+	hashes     map[string]string
+	mtimes     map[string]int64
+	tombstones map[string]*Tombstone
+}
+
+func init() {
+	RegisterBackend("memory", func(cfg StorageConfig, maxFileSizeMB int) (StorageBackend, error) {
+		return NewMemoryBackend(), nil
+	})
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		files:      make(map[string][]byte),
+		hashes:     make(map[string]string),
+		mtimes:     make(map[string]int64),
+		tombstones: make(map[string]*Tombstone),
+	}
+}
+
+func (m *MemoryBackend) WriteFile(path string, content []byte, mtime int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored := make([]byte, len(content))
+	copy(stored, content)
+	m.files[path] = stored
+	m.hashes[path] = sha256Hex(stored)
+	m.mtimes[path] = mtime
+	return nil
+}
+
+func (m *MemoryBackend) ReadFile(path string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	content, ok := m.files[path]
+	if !ok {
+		return nil, fmt.Errorf("file not found: %s", path)
+	}
+	return content, nil
+}
+
+func (m *MemoryBackend) DeleteFile(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.files, path)
+	delete(m.hashes, path)
+	delete(m.mtimes, path)
+	return nil
+}
+
+func (m *MemoryBackend) GetFileHash(path string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.hashes[path]
+}
+
+func (m *MemoryBackend) GetFileInfo(path string) (*FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	content, ok := m.files[path]
+	if !ok {
+		return nil, fmt.Errorf("file not found: %s", path)
+	}
+	return &FileInfo{
+		Path:    path,
+		Hash:    m.hashes[path],
+		Size:    int64(len(content)),
+		ModTime: m.mtimes[path],
+	}, nil
+}
+
+func (m *MemoryBackend) ListFiles() ([]*FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	files := make([]*FileInfo, 0, len(m.files))
+	for path, content := range m.files {
+		files = append(files, &FileInfo{
+			Path:    path,
+			Hash:    m.hashes[path],
+			Size:    int64(len(content)),
+			ModTime: m.mtimes[path],
+		})
+	}
+	return files, nil
+}
+
+func (m *MemoryBackend) CreateTombstone(path, deviceID string, vectorClock map[string]int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().Unix()
+	m.tombstones[path] = &Tombstone{
+		Path:        path,
+		DeletedAt:   now,
+		DeletedBy:   deviceID,
+		VectorClock: vectorClock,
+		TTL:         now + (30 * 24 * 60 * 60),
+	}
+}
+
+func (m *MemoryBackend) GetTombstone(path string) *Tombstone {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.tombstones[path]
+}
+
+func (m *MemoryBackend) DeleteTombstone(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tombstones, path)
+}
+
+func (m *MemoryBackend) ListTombstones() []*Tombstone {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := make([]*Tombstone, 0, len(m.tombstones))
+	for _, tomb := range m.tombstones {
+		result = append(result, tomb)
+	}
+	return result
+}
+
+func (m *MemoryBackend) CleanupExpiredTombstones() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().Unix()
+	count := 0
+	for path, tomb := range m.tombstones {
+		if tomb.TTL < now {
+			delete(m.tombstones, path)
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// s3TombstonePrefix namespaces tombstone sidecar objects away from vault
+// content, mirroring the local backend's manifestsDirName convention.
+const s3TombstonePrefix = ".tombstones/"
+
+// S3Backend stores vault content as objects in an S3-compatible bucket.
+// GetFileHash reports the SHA-256 of the content, computed locally on every
+// WriteFile (cheap - we already have the bytes in hand) and cached in
+// hashes, the same content-addressable value the local, WebDAV, and memory
+// backends report. It used to be served from each object's ETag instead,
+// since S3 already maintains that for us, but ETag is an opaque,
+// backend-specific token (and an MD5, not a SHA-256, for non-multipart
+// PUTs) - comparing it against the SHA-256 previousHash clients send in
+// handleFileChange made every overwrite of an S3-backed vault look like a
+// conflict. The cache is only as fresh as this process's own writes, same
+// as before; an object nobody has written through this process yet reports
+// an empty hash rather than re-downloading it just to hash it.
+type S3Backend struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	prefix    string
+
+	client *http.Client
+
+	mu     sync.RWMutex
+	hashes map[string]string
+}
+
+func init() {
+	RegisterBackend("s3", func(cfg StorageConfig, maxFileSizeMB int) (StorageBackend, error) {
+		s3cfg := cfg.S3
+		if s3cfg.Endpoint == "" || s3cfg.Bucket == "" {
+			return nil, fmt.Errorf("storage.s3.endpoint and storage.s3.bucket are required for the s3 backend")
+		}
+		return &S3Backend{
+			endpoint:  strings.TrimSuffix(s3cfg.Endpoint, "/"),
+			bucket:    s3cfg.Bucket,
+			region:    s3cfg.Region,
+			accessKey: s3cfg.AccessKey,
+			secretKey: s3cfg.SecretKey,
+			prefix:    strings.Trim(s3cfg.Prefix, "/"),
+			client:    &http.Client{Timeout: 60 * time.Second},
+			hashes:    make(map[string]string),
+		}, nil
+	})
+}
+
+func (b *S3Backend) key(p string) string {
+	if b.prefix == "" {
+		return p
+	}
+	return b.prefix + "/" + p
+}
+
+func (b *S3Backend) WriteFile(p string, content []byte, mtime int64) error {
+	key := b.key(p)
+	resp, err := b.do("PUT", key, content, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("s3 PUT %s: %s", key, resp.Status)
+	}
+
+	b.mu.Lock()
+	b.hashes[p] = sha256Hex(content)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *S3Backend) ReadFile(p string) ([]byte, error) {
+	resp, err := b.do("GET", b.key(p), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %w", p, os.ErrNotExist)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("s3 GET %s: %s", b.key(p), resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (b *S3Backend) DeleteFile(p string) error {
+	resp, err := b.do("DELETE", b.key(p), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("s3 DELETE %s: %s", b.key(p), resp.Status)
+	}
+
+	b.mu.Lock()
+	delete(b.hashes, p)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *S3Backend) GetFileHash(p string) string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.hashes[p]
+}
+
+// GetFileInfo HEADs the object for its size and mtime. It can't derive a
+// fresh SHA-256 from a HEAD response (no body), so Hash is whatever this
+// process has cached for p from a prior WriteFile - empty if nothing has
+// written p through this backend yet.
+func (b *S3Backend) GetFileInfo(p string) (*FileInfo, error) {
+	resp, err := b.do("HEAD", b.key(p), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %w", p, os.ErrNotExist)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("s3 HEAD %s: %s", b.key(p), resp.Status)
+	}
+
+	size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	modTime := int64(0)
+	if lm := resp.Header.Get("Last-Modified"); lm != "" {
+		if t, err := http.ParseTime(lm); err == nil {
+			modTime = t.UnixMilli()
+		}
+	}
+
+	b.mu.RLock()
+	hash := b.hashes[p]
+	b.mu.RUnlock()
+
+	return &FileInfo{Path: p, Hash: hash, Size: size, ModTime: modTime}, nil
+}
+
+// listBucketResult is the subset of ListObjectsV2's XML response we need.
+// Its ETag isn't surfaced as FileInfo.Hash (see S3Backend's doc comment) -
+// it's only here because ListObjectsV2 happens to include it for free.
+type listBucketResult struct {
+	Contents []struct {
+		Key          string `xml:"Key"`
+		ETag         string `xml:"ETag"`
+		Size         int64  `xml:"Size"`
+		LastModified string `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (b *S3Backend) listObjects(prefix string) ([]FileInfo, error) {
+	var results []FileInfo
+	token := ""
+
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := b.doQuery("GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode/100 != 2 {
+			return nil, fmt.Errorf("s3 ListObjectsV2: %s", resp.Status)
+		}
+
+		var parsed listBucketResult
+		if err := xml.Unmarshal(data, &parsed); err != nil {
+			return nil, err
+		}
+
+		for _, obj := range parsed.Contents {
+			modTime := int64(0)
+			if t, err := time.Parse(time.RFC3339, obj.LastModified); err == nil {
+				modTime = t.UnixMilli()
+			}
+			results = append(results, FileInfo{
+				Path:    obj.Key,
+				Size:    obj.Size,
+				ModTime: modTime,
+			})
+		}
+
+		if !parsed.IsTruncated {
+			break
+		}
+		token = parsed.NextContinuationToken
+	}
+
+	return results, nil
+}
+
+// ListFiles reports each object's SHA-256 from this process's hashes cache
+// (see S3Backend's doc comment), not from ListObjectsV2's ETag, so it stays
+// directly comparable to the previousHash clients send.
+func (b *S3Backend) ListFiles() ([]*FileInfo, error) {
+	prefix := b.prefix
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	objects, err := b.listObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*FileInfo, 0, len(objects))
+	b.mu.RLock()
+	for _, obj := range objects {
+		if strings.HasPrefix(obj.Path, prefix+s3TombstonePrefix) {
+			continue
+		}
+		relPath := strings.TrimPrefix(obj.Path, prefix)
+		info := obj
+		info.Path = relPath
+		info.Hash = b.hashes[relPath]
+		files = append(files, &info)
+	}
+	b.mu.RUnlock()
+
+	return files, nil
+}
+
+func (b *S3Backend) tombstoneKey(p string) string {
+	return b.key(s3TombstonePrefix + p + ".json")
+}
+
+func (b *S3Backend) CreateTombstone(p, deviceID string, vectorClock map[string]int64) {
+	now := time.Now().Unix()
+	tomb := &Tombstone{
+		Path:        p,
+		DeletedAt:   now,
+		DeletedBy:   deviceID,
+		VectorClock: vectorClock,
+		TTL:         now + (30 * 24 * 60 * 60),
+	}
+	data, err := json.Marshal(tomb)
+	if err != nil {
+		return
+	}
+	resp, err := b.do("PUT", b.tombstoneKey(p), data, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (b *S3Backend) GetTombstone(p string) *Tombstone {
+	resp, err := b.do("GET", b.tombstoneKey(p), nil, nil)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil
+	}
+	var tomb Tombstone
+	if err := json.Unmarshal(data, &tomb); err != nil {
+		return nil
+	}
+	return &tomb
+}
+
+func (b *S3Backend) DeleteTombstone(p string) {
+	resp, err := b.do("DELETE", b.tombstoneKey(p), nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (b *S3Backend) ListTombstones() []*Tombstone {
+	prefix := b.key(s3TombstonePrefix)
+	objects, err := b.listObjects(prefix)
+	if err != nil {
+		return nil
+	}
+
+	var tombstones []*Tombstone
+	for _, obj := range objects {
+		resp, err := b.do("GET", obj.Path, nil, nil)
+		if err != nil {
+			continue
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			continue
+		}
+		var tomb Tombstone
+		if json.Unmarshal(data, &tomb) == nil {
+			tombstones = append(tombstones, &tomb)
+		}
+	}
+	return tombstones
+}
+
+func (b *S3Backend) CleanupExpiredTombstones() int {
+	now := time.Now().Unix()
+	count := 0
+	for _, tomb := range b.ListTombstones() {
+		if tomb.TTL < now {
+			b.DeleteTombstone(tomb.Path)
+			count++
+		}
+	}
+	return count
+}
+
+// do issues a SigV4-signed request for a single-object key under the
+// backend's bucket.
+func (b *S3Backend) do(method, key string, body []byte, extraHeaders http.Header) (*http.Response, error) {
+	return b.doQuery(method, key, nil, body, extraHeaders)
+}
+
+// doQuery issues a SigV4-signed request, optionally against the bucket root
+// (key == "") with query parameters, used for ListObjectsV2.
+func (b *S3Backend) doQuery(method, key string, query url.Values, body []byte, extraHeaders http.Header) (*http.Response, error) {
+	reqURL := fmt.Sprintf("%s/%s", b.endpoint, b.bucket)
+	if key != "" {
+		reqURL += "/" + path.Join(key)
+	}
+	if len(query) > 0 {
+		reqURL += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, reqURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range extraHeaders {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+
+	if err := b.sign(req, body); err != nil {
+		return nil, err
+	}
+
+	return b.client.Do(req)
+}
+
+// sign applies AWS Signature Version 4 to req, the scheme S3-compatible
+// services (AWS S3, MinIO, etc.) expect on every request.
+func (b *S3Backend) sign(req *http.Request, body []byte) error {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	dateStamp := now.Format("20060102")
+
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if req.Host == "" {
+		req.Host = req.URL.Host
+	}
+
+	canonicalHeaders, signedHeaders := canonicalizeHeaders(req)
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL.Path),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	region := b.region
+	if region == "" {
+		region = "us-east-1"
+	}
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", dateStamp, region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSHA256(hmacSHA256(hmacSHA256(hmacSHA256([]byte("AWS4"+b.secretKey), dateStamp), region), "s3"), "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.accessKey, scope, signedHeaders, signature,
+	))
+	return nil
+}
+
+func canonicalURI(p string) string {
+	if p == "" {
+		return "/"
+	}
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+func canonicalizeHeaders(req *http.Request) (canonical, signed string) {
+	headers := map[string]string{
+		"host":                 req.Host,
+		"x-amz-date":           req.Header.Get("X-Amz-Date"),
+		"x-amz-content-sha256": req.Header.Get("X-Amz-Content-Sha256"),
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sortStrings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(headers[name])
+		b.WriteByte('\n')
+	}
+	return b.String(), strings.Join(names, ";")
+}
+
+func sortStrings(s []string) {
+	for i := 1; i < len(s); i++ {
+		for j := i; j > 0 && s[j-1] > s[j]; j-- {
+			s[j-1], s[j] = s[j], s[j-1]
+		}
+	}
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webdavTombstoneDir namespaces tombstone sidecar files away from vault
+// content, mirroring the local backend's manifestsDirName convention.
+const webdavTombstoneDir = ".tombstones"
+
+// WebDAVBackend stores vault content as files on a WebDAV server. Unlike
+// S3, WebDAV has no native per-object checksum, so hashes are computed
+// lazily on first read/write and cached in memory rather than upfront.
+type WebDAVBackend struct {
+	baseURL  string
+	username string
+	password string
+	prefix   string
+
+	client *http.Client
+
+	mu     sync.RWMutex
+	hashes map[string]string
+}
+
+func init() {
+	RegisterBackend("webdav", func(cfg StorageConfig, maxFileSizeMB int) (StorageBackend, error) {
+		davCfg := cfg.WebDAV
+		if davCfg.URL == "" {
+			return nil, fmt.Errorf("storage.webdav.url is required for the webdav backend")
+		}
+		return &WebDAVBackend{
+			baseURL:  strings.TrimSuffix(davCfg.URL, "/"),
+			username: davCfg.Username,
+			password: davCfg.Password,
+			prefix:   strings.Trim(davCfg.Prefix, "/"),
+			client:   &http.Client{Timeout: 60 * time.Second},
+			hashes:   make(map[string]string),
+		}, nil
+	})
+}
+
+func (b *WebDAVBackend) url(p string) string {
+	key := p
+	if b.prefix != "" {
+		key = b.prefix + "/" + p
+	}
+	return b.baseURL + "/" + path.Join(strings.Split(key, "/")...)
+}
+
+func (b *WebDAVBackend) request(method, rawURL string, body []byte, headers map[string]string) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, rawURL, reader)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if b.username != "" {
+		req.SetBasicAuth(b.username, b.password)
+	}
+	return b.client.Do(req)
+}
+
+// mkdirAll issues MKCOL for every parent collection of p, ignoring
+// already-exists responses - WebDAV has no mkdir -p equivalent.
+func (b *WebDAVBackend) mkdirAll(p string) {
+	dir := path.Dir(p)
+	if dir == "." || dir == "/" {
+		return
+	}
+
+	var parts []string
+	for _, part := range strings.Split(dir, "/") {
+		if part == "" {
+			continue
+		}
+		parts = append(parts, part)
+		resp, err := b.request("MKCOL", b.url(strings.Join(parts, "/")), nil, nil)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+func (b *WebDAVBackend) WriteFile(p string, content []byte, mtime int64) error {
+	b.mkdirAll(p)
+
+	resp, err := b.request("PUT", b.url(p), content, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webdav PUT %s: %s", p, resp.Status)
+	}
+
+	b.mu.Lock()
+	b.hashes[p] = sha256Hex(content)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *WebDAVBackend) ReadFile(p string) ([]byte, error) {
+	resp, err := b.request("GET", b.url(p), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %w", p, os.ErrNotExist)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("webdav GET %s: %s", p, resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	b.hashes[p] = sha256Hex(data)
+	b.mu.Unlock()
+	return data, nil
+}
+
+func (b *WebDAVBackend) DeleteFile(p string) error {
+	resp, err := b.request("DELETE", b.url(p), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("webdav DELETE %s: %s", p, resp.Status)
+	}
+
+	b.mu.Lock()
+	delete(b.hashes, p)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *WebDAVBackend) GetFileHash(p string) string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.hashes[p]
+}
+
+// multistatus is the subset of a WebDAV PROPFIND response we need.
+type multistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat struct {
+			Prop struct {
+				ContentLength string `xml:"getcontentlength"`
+				LastModified  string `xml:"getlastmodified"`
+				ResourceType  struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+func (b *WebDAVBackend) propfind(rawURL string, depth string) (*multistatus, error) {
+	resp, err := b.request("PROPFIND", rawURL, nil, map[string]string{"Depth": depth})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %w", rawURL, os.ErrNotExist)
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("webdav PROPFIND %s: %s", rawURL, resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed multistatus
+	if err := xml.Unmarshal(data, &parsed); err != nil {
+		return nil, err
+	}
+	return &parsed, nil
+}
+
+func (b *WebDAVBackend) GetFileInfo(p string) (*FileInfo, error) {
+	result, err := b.propfind(b.url(p), "0")
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Responses) == 0 {
+		return nil, fmt.Errorf("%s: %w", p, os.ErrNotExist)
+	}
+
+	prop := result.Responses[0].Propstat.Prop
+	size, _ := strconv.ParseInt(prop.ContentLength, 10, 64)
+	modTime := int64(0)
+	if t, err := http.ParseTime(prop.LastModified); err == nil {
+		modTime = t.UnixMilli()
+	}
+
+	b.mu.RLock()
+	hash := b.hashes[p]
+	b.mu.RUnlock()
+
+	return &FileInfo{Path: p, Hash: hash, Size: size, ModTime: modTime}, nil
+}
+
+func (b *WebDAVBackend) ListFiles() ([]*FileInfo, error) {
+	root := b.baseURL
+	if b.prefix != "" {
+		root = b.url("")
+	}
+
+	result, err := b.propfind(root, "infinity")
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*FileInfo
+	for _, r := range result.Responses {
+		if r.Propstat.Prop.ResourceType.Collection != nil {
+			continue
+		}
+
+		relPath := strings.TrimPrefix(r.Href, b.baseURL)
+		relPath = strings.Trim(relPath, "/")
+		if b.prefix != "" {
+			relPath = strings.TrimPrefix(relPath, b.prefix+"/")
+		}
+		if relPath == "" || strings.HasPrefix(relPath, webdavTombstoneDir+"/") {
+			continue
+		}
+
+		size, _ := strconv.ParseInt(r.Propstat.Prop.ContentLength, 10, 64)
+		modTime := int64(0)
+		if t, err := http.ParseTime(r.Propstat.Prop.LastModified); err == nil {
+			modTime = t.UnixMilli()
+		}
+
+		b.mu.RLock()
+		hash := b.hashes[relPath]
+		b.mu.RUnlock()
+
+		files = append(files, &FileInfo{Path: relPath, Hash: hash, Size: size, ModTime: modTime})
+	}
+
+	return files, nil
+}
+
+func (b *WebDAVBackend) tombstonePath(p string) string {
+	return webdavTombstoneDir + "/" + p + ".json"
+}
+
+func (b *WebDAVBackend) CreateTombstone(p, deviceID string, vectorClock map[string]int64) {
+	now := time.Now().Unix()
+	tomb := &Tombstone{
+		Path:        p,
+		DeletedAt:   now,
+		DeletedBy:   deviceID,
+		VectorClock: vectorClock,
+		TTL:         now + (30 * 24 * 60 * 60),
+	}
+	data, err := json.Marshal(tomb)
+	if err != nil {
+		return
+	}
+
+	tombPath := b.tombstonePath(p)
+	b.mkdirAll(tombPath)
+	resp, err := b.request("PUT", b.url(tombPath), data, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (b *WebDAVBackend) GetTombstone(p string) *Tombstone {
+	resp, err := b.request("GET", b.url(b.tombstonePath(p)), nil, nil)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil
+	}
+	var tomb Tombstone
+	if err := json.Unmarshal(data, &tomb); err != nil {
+		return nil
+	}
+	return &tomb
+}
+
+func (b *WebDAVBackend) DeleteTombstone(p string) {
+	resp, err := b.request("DELETE", b.url(b.tombstonePath(p)), nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (b *WebDAVBackend) ListTombstones() []*Tombstone {
+	result, err := b.propfind(b.url(webdavTombstoneDir), "infinity")
+	if err != nil {
+		return nil
+	}
+
+	var tombstones []*Tombstone
+	for _, r := range result.Responses {
+		if r.Propstat.Prop.ResourceType.Collection != nil {
+			continue
+		}
+		resp, err := b.request("GET", b.baseURL+r.Href, nil, nil)
+		if err != nil {
+			continue
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			continue
+		}
+		var tomb Tombstone
+		if json.Unmarshal(data, &tomb) == nil {
+			tombstones = append(tombstones, &tomb)
+		}
+	}
+	return tombstones
+}
+
+func (b *WebDAVBackend) CleanupExpiredTombstones() int {
+	now := time.Now().Unix()
+	count := 0
+	for _, tomb := range b.ListTombstones() {
+		if tomb.TTL < now {
+			b.DeleteTombstone(tomb.Path)
+			count++
+		}
+	}
+	return count
+}
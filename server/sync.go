@@ -1,7 +1,12 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"sync"
 )
@@ -35,6 +40,39 @@ type FileMovePayload struct {
 	Hash    string `json:"hash"`
 }
 
+// Block-based delta sync: the client announces a file as a manifest of
+// content-addressed blocks, the server asks back for whatever it doesn't
+// already have, and the client uploads just those blocks.
+
+type BlockInfo struct {
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	Hash   string `json:"hash"`
+}
+
+type FileManifest struct {
+	Path         string      `json:"path"`
+	MTime        int64       `json:"mtime"`
+	TotalHash    string      `json:"totalHash"`
+	PreviousHash string      `json:"previousHash,omitempty"`
+	BlockSize    int64       `json:"blockSize"`
+	Blocks       []BlockInfo `json:"blocks"`
+}
+
+// NeedBlocksPayload is the server's reply to a file_manifest message,
+// listing the block hashes it doesn't already have.
+type NeedBlocksPayload struct {
+	Path   string   `json:"path"`
+	Hashes []string `json:"hashes"`
+}
+
+// BlockDataPayload carries a single requested block, keyed by hash.
+type BlockDataPayload struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+	Data string `json:"data"` // Base64 encoded
+}
+
 // Server -> Client messages
 type ServerMessage struct {
 	Type         string      `json:"type"`
@@ -43,9 +81,10 @@ type ServerMessage struct {
 }
 
 type FullSyncPayload struct {
-	Files       []*FileInfo   `json:"files"`
-	Tombstones  []*Tombstone  `json:"tombstones"`
+	Files       []*FileInfo      `json:"files"`
+	Tombstones  []*Tombstone     `json:"tombstones"`
 	VectorClock map[string]int64 `json:"vectorClock"`
+	Manifests   []*FileManifest  `json:"manifests,omitempty"`
 }
 
 type ConflictPayload struct {
@@ -56,19 +95,33 @@ type ConflictPayload struct {
 }
 
 type SyncManager struct {
-	storage            *Storage
+	storage            StorageBackend
 	hub                *Hub
 	conflictResolution string
+	locks              *LockManager
 	vectorClock        map[string]int64
 	mu                 sync.RWMutex
+
+	pendingUploads map[string]*pendingUpload
+	pendingMu      sync.Mutex
 }
 
-func NewSyncManager(storage *Storage, hub *Hub, conflictResolution string) *SyncManager {
+// pendingUpload tracks an in-flight block-based upload: the manifest the
+// client announced and the block hashes still missing from the store.
+type pendingUpload struct {
+	manifest *FileManifest
+	needed   map[string]bool
+	deviceID string
+}
+
+func NewSyncManager(storage StorageBackend, hub *Hub, conflictResolution string, locks *LockManager) *SyncManager {
 	return &SyncManager{
 		storage:            storage,
 		hub:                hub,
 		conflictResolution: conflictResolution,
+		locks:              locks,
 		vectorClock:        make(map[string]int64),
+		pendingUploads:     make(map[string]*pendingUpload),
 	}
 }
 
@@ -152,6 +205,10 @@ func (s *SyncManager) HandleMessage(deviceID string, msg *SyncMessage) {
 		s.sendFullSync(deviceID)
 	case "request_file":
 		s.handleRequestFile(deviceID, msg)
+	case "file_manifest":
+		s.handleFileManifest(deviceID, msg)
+	case "block_data":
+		s.handleBlockData(deviceID, msg)
 	case "ping":
 		s.hub.SendTo(deviceID, ServerMessage{Type: "pong"})
 	default:
@@ -159,6 +216,29 @@ func (s *SyncManager) HandleMessage(deviceID string, msg *SyncMessage) {
 	}
 }
 
+// rejectIfLocked tells deviceID no and returns true if path is locked by
+// another device (see LockManager.CheckWritable). s.locks is nil when
+// NewSyncManager was given no LockManager, in which case locking is simply
+// not enforced.
+func (s *SyncManager) rejectIfLocked(deviceID, path string) bool {
+	if s.locks == nil {
+		return false
+	}
+
+	if err := s.locks.CheckWritable(path, deviceID); err != nil {
+		var conflict *LockConflictError
+		if errors.As(err, &conflict) {
+			log.Printf("Rejecting write to %s from %s: %v", path, deviceID, err)
+			s.hub.SendTo(deviceID, ServerMessage{
+				Type:    "file_locked",
+				Payload: map[string]string{"path": path, "holder": conflict.Holder},
+			})
+			return true
+		}
+	}
+	return false
+}
+
 func (s *SyncManager) handleFileChange(deviceID string, msg *SyncMessage) {
 	payload, ok := s.extractFileChangePayload(msg.Payload)
 	if !ok {
@@ -173,6 +253,10 @@ func (s *SyncManager) handleFileChange(deviceID string, msg *SyncMessage) {
 		return
 	}
 
+	if s.rejectIfLocked(deviceID, payload.Path) {
+		return
+	}
+
 	// Check for conflicts
 	existingHash := s.storage.GetFileHash(payload.Path)
 	if existingHash != "" && payload.PreviousHash != "" && existingHash != payload.PreviousHash {
@@ -197,6 +281,175 @@ func (s *SyncManager) handleFileChange(deviceID string, msg *SyncMessage) {
 	})
 }
 
+// handleFileManifest is the first phase of block-based delta sync: the
+// client announces a file as a manifest of content-addressed blocks, and
+// the server replies with whatever blocks it doesn't already have.
+func (s *SyncManager) handleFileManifest(deviceID string, msg *SyncMessage) {
+	blockStore, ok := s.storage.(BlockStore)
+	if !ok {
+		log.Printf("Storage backend does not support block-based sync; rejecting manifest from %s", deviceID)
+		s.hub.SendTo(deviceID, ServerMessage{Type: "manifest_unsupported"})
+		return
+	}
+
+	var manifest FileManifest
+	if !decodePayload(msg.Payload, &manifest) {
+		log.Printf("Invalid file_manifest payload from %s", deviceID)
+		return
+	}
+
+	needed := make(map[string]bool)
+	for _, b := range manifest.Blocks {
+		if isZeroBlockHash(b.Size, b.Hash) {
+			continue
+		}
+		if !blockStore.HasBlock(b.Hash) {
+			needed[b.Hash] = true
+		}
+	}
+
+	s.pendingMu.Lock()
+	s.pendingUploads[manifest.Path] = &pendingUpload{manifest: &manifest, needed: needed, deviceID: deviceID}
+	s.pendingMu.Unlock()
+
+	if len(needed) == 0 {
+		log.Printf("Manifest for %s from %s: all %d blocks already present", manifest.Path, deviceID, len(manifest.Blocks))
+		s.finishManifestUpload(manifest.Path)
+		return
+	}
+
+	hashes := make([]string, 0, len(needed))
+	for h := range needed {
+		hashes = append(hashes, h)
+	}
+
+	log.Printf("Manifest for %s from %s: need %d/%d blocks", manifest.Path, deviceID, len(hashes), len(manifest.Blocks))
+
+	s.hub.SendTo(deviceID, ServerMessage{
+		Type:    "need_blocks",
+		Payload: NeedBlocksPayload{Path: manifest.Path, Hashes: hashes},
+	})
+}
+
+// handleBlockData is the second phase of block-based delta sync: the client
+// uploads one previously-requested block. Once every needed block for a
+// path has arrived, the file is reconstructed and written to storage.
+func (s *SyncManager) handleBlockData(deviceID string, msg *SyncMessage) {
+	blockStore, ok := s.storage.(BlockStore)
+	if !ok {
+		log.Printf("Storage backend does not support block-based sync; rejecting block from %s", deviceID)
+		return
+	}
+
+	var block BlockDataPayload
+	if !decodePayload(msg.Payload, &block) {
+		log.Printf("Invalid block_data payload from %s", deviceID)
+		return
+	}
+
+	data, err := base64.StdEncoding.DecodeString(block.Data)
+	if err != nil {
+		log.Printf("Failed to decode block %s from %s: %v", block.Hash, deviceID, err)
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != block.Hash {
+		log.Printf("Block content from %s does not match hash %s; dropping", deviceID, block.Hash)
+		return
+	}
+
+	if err := blockStore.WriteBlock(block.Hash, data); err != nil {
+		log.Printf("Failed to store block %s from %s: %v", block.Hash, deviceID, err)
+		return
+	}
+
+	s.pendingMu.Lock()
+	pending, ok := s.pendingUploads[block.Path]
+	if !ok {
+		s.pendingMu.Unlock()
+		return
+	}
+	delete(pending.needed, block.Hash)
+	done := len(pending.needed) == 0
+	s.pendingMu.Unlock()
+
+	if done {
+		s.finishManifestUpload(block.Path)
+	}
+}
+
+// finishManifestUpload reconstructs a file from its (now fully uploaded)
+// manifest, writes it to storage, and broadcasts the manifest to peers.
+func (s *SyncManager) finishManifestUpload(path string) {
+	s.pendingMu.Lock()
+	pending, ok := s.pendingUploads[path]
+	if ok {
+		delete(s.pendingUploads, path)
+	}
+	s.pendingMu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	blockStore, ok := s.storage.(BlockStore)
+	if !ok {
+		log.Printf("Storage backend does not support block-based sync; dropping pending upload for %s", path)
+		return
+	}
+
+	content, err := blockStore.ReconstructFromManifest(pending.manifest)
+	if err != nil {
+		log.Printf("Failed to reconstruct %s from blocks: %v", path, err)
+		return
+	}
+
+	sum := sha256.Sum256(content)
+	if hex.EncodeToString(sum[:]) != pending.manifest.TotalHash {
+		log.Printf("Reconstructed content for %s does not match manifest totalHash; discarding", path)
+		return
+	}
+
+	if s.rejectIfLocked(pending.deviceID, path) {
+		return
+	}
+
+	// Same conflict gate as the whole-file path in handleFileChange: a
+	// manifest upload is just as capable of clobbering a concurrent edit as
+	// a plain file_change, so it needs the same previousHash check before
+	// WriteFile commits it.
+	existingHash := s.storage.GetFileHash(path)
+	if existingHash != "" && pending.manifest.PreviousHash != "" && existingHash != pending.manifest.PreviousHash {
+		clientVersion := &FileChangePayload{
+			Path:         path,
+			Content:      base64.StdEncoding.EncodeToString(content),
+			MTime:        pending.manifest.MTime,
+			Hash:         pending.manifest.TotalHash,
+			PreviousHash: pending.manifest.PreviousHash,
+		}
+		s.handleConflict(pending.deviceID, clientVersion, existingHash)
+		return
+	}
+
+	if err := s.storage.WriteFile(path, content, pending.manifest.MTime); err != nil {
+		log.Printf("Failed to write reconstructed file %s: %v", path, err)
+		return
+	}
+
+	if err := blockStore.SaveManifest(path, pending.manifest); err != nil {
+		log.Printf("Failed to save manifest for %s: %v", path, err)
+	}
+
+	log.Printf("File synced via blocks: %s (from %s, %d blocks)", path, pending.deviceID, len(pending.manifest.Blocks))
+
+	s.hub.Broadcast(pending.deviceID, ServerMessage{
+		Type:         "file_manifest_changed",
+		OriginDevice: pending.deviceID,
+		Payload:      pending.manifest,
+	})
+}
+
 func (s *SyncManager) handleFileDelete(deviceID string, msg *SyncMessage) {
 	payload, ok := s.extractFileDeletePayload(msg.Payload)
 	if !ok {
@@ -204,6 +457,10 @@ func (s *SyncManager) handleFileDelete(deviceID string, msg *SyncMessage) {
 		return
 	}
 
+	if s.rejectIfLocked(deviceID, payload.Path) {
+		return
+	}
+
 	// Delete physical file
 	if err := s.storage.DeleteFile(payload.Path); err != nil {
 		log.Printf("Failed to delete file %s: %v", payload.Path, err)
@@ -238,6 +495,10 @@ func (s *SyncManager) handleFileMove(deviceID string, msg *SyncMessage) {
 		return
 	}
 
+	if s.rejectIfLocked(deviceID, payload.OldPath) || s.rejectIfLocked(deviceID, payload.NewPath) {
+		return
+	}
+
 	// Delete old file first
 	if err := s.storage.DeleteFile(payload.OldPath); err != nil {
 		log.Printf("Failed to delete old file %s during move: %v", payload.OldPath, err)
@@ -260,6 +521,127 @@ func (s *SyncManager) handleFileMove(deviceID string, msg *SyncMessage) {
 	})
 }
 
+// streamUploadMeta is the OPEN-frame payload for a "file_upload" mux
+// stream request: file metadata without the content, which arrives as
+// subsequent DATA frames.
+type streamUploadMeta struct {
+	Path         string `json:"path"`
+	MTime        int64  `json:"mtime"`
+	PreviousHash string `json:"previousHash,omitempty"`
+	TotalHash    string `json:"totalHash,omitempty"`
+}
+
+// streamDownloadMeta is the OPEN-frame payload for a "file_download" mux
+// stream request.
+type streamDownloadMeta struct {
+	Path string `json:"path"`
+}
+
+// HandleStreamUpload is the StreamRequestHandler backing the "file_upload"
+// mux request type: it writes incoming chunks straight to storage instead
+// of buffering a whole base64 message, and can be cancelled mid-transfer if
+// the peer disappears. The `in` channel closing early (CANCEL, disconnect,
+// or a failed slow-consumer stream) looks identical to a clean END from the
+// loop's point of view, so `aborted` - backed by MuxServer's serverStream -
+// is what actually tells the two apart; only a clean END commits the
+// upload, and only with a matching hash when TotalHash is given (an empty
+// TotalHash skips the check).
+func (s *SyncManager) HandleStreamUpload(deviceID string, initial []byte, in <-chan []byte, aborted func() bool) (<-chan []byte, error) {
+	var meta streamUploadMeta
+	if err := json.Unmarshal(initial, &meta); err != nil {
+		return nil, fmt.Errorf("invalid file_upload request: %w", err)
+	}
+
+	existingHash := s.storage.GetFileHash(meta.Path)
+	if existingHash != "" && meta.PreviousHash != "" && existingHash != meta.PreviousHash {
+		return nil, fmt.Errorf("conflict: %s changed since previousHash", meta.Path)
+	}
+
+	if s.locks != nil {
+		if err := s.locks.CheckWritable(meta.Path, deviceID); err != nil {
+			return nil, err
+		}
+	}
+
+	streamable, ok := s.storage.(StreamableStore)
+	if !ok {
+		return nil, fmt.Errorf("storage backend does not support streamed uploads")
+	}
+
+	writer, err := streamable.OpenWriteStream(meta.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	for chunk := range in {
+		if err := writer.Write(chunk); err != nil {
+			writer.Abort()
+			return nil, err
+		}
+	}
+
+	if aborted() {
+		writer.Abort()
+		return nil, fmt.Errorf("upload of %s aborted before completion", meta.Path)
+	}
+
+	if meta.TotalHash != "" && writer.Sum() != meta.TotalHash {
+		writer.Abort()
+		return nil, fmt.Errorf("streamed content for %s does not match totalHash", meta.Path)
+	}
+
+	if err := writer.Finish(meta.MTime); err != nil {
+		return nil, err
+	}
+
+	log.Printf("File streamed: %s (from %s)", meta.Path, deviceID)
+
+	s.hub.Broadcast(deviceID, ServerMessage{
+		Type:         "file_changed",
+		OriginDevice: deviceID,
+		Payload: &FileChangePayload{
+			Path:  meta.Path,
+			MTime: meta.MTime,
+			Hash:  s.storage.GetFileHash(meta.Path),
+		},
+	})
+
+	ack := make(chan []byte, 1)
+	ack <- []byte(`{"status":"ok"}`)
+	close(ack)
+	return ack, nil
+}
+
+// HandleStreamDownload is the StreamRequestHandler backing the
+// "file_download" mux request type: it reads the file once and streams it
+// back in streamChunkSize-sized frames instead of one large base64 message.
+func (s *SyncManager) HandleStreamDownload(deviceID string, initial []byte) (<-chan []byte, error) {
+	var meta streamDownloadMeta
+	if err := json.Unmarshal(initial, &meta); err != nil {
+		return nil, fmt.Errorf("invalid file_download request: %w", err)
+	}
+
+	content, err := s.storage.ReadFile(meta.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Streaming file %s to %s (%d bytes)", meta.Path, deviceID, len(content))
+
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		for offset := 0; offset < len(content); offset += streamChunkSize {
+			end := offset + streamChunkSize
+			if end > len(content) {
+				end = len(content)
+			}
+			out <- content[offset:end]
+		}
+	}()
+	return out, nil
+}
+
 func (s *SyncManager) handleConflict(deviceID string, clientVersion *FileChangePayload, serverHash string) {
 	log.Printf("Conflict detected for %s from %s", clientVersion.Path, deviceID)
 
@@ -357,7 +739,12 @@ func (s *SyncManager) sendFullSync(deviceID string) {
 	tombstones := s.storage.ListTombstones()
 	vectorClock := s.getVectorClock()
 
-	log.Printf("Sending full sync to %s: %d files, %d tombstones", deviceID, len(files), len(tombstones))
+	var manifests []*FileManifest
+	if blockStore, ok := s.storage.(BlockStore); ok {
+		manifests = blockStore.ListManifests()
+	}
+
+	log.Printf("Sending full sync to %s: %d files, %d tombstones, %d manifests", deviceID, len(files), len(tombstones), len(manifests))
 
 	s.hub.SendTo(deviceID, ServerMessage{
 		Type: "full_sync",
@@ -365,6 +752,7 @@ func (s *SyncManager) sendFullSync(deviceID string) {
 			Files:       files,
 			Tombstones:  tombstones,
 			VectorClock: vectorClock,
+			Manifests:   manifests,
 		},
 	})
 }
@@ -402,6 +790,20 @@ func (s *SyncManager) handleRequestFile(deviceID string, msg *SyncMessage) {
 	})
 }
 
+// decodePayload round-trips payload (already a map[string]interface{} from
+// JSON decoding) through JSON into out. Used for the newer, more structured
+// message payloads where field-by-field extraction would be unwieldy.
+func decodePayload(payload interface{}, out interface{}) bool {
+	if payload == nil {
+		return false
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, out) == nil
+}
+
 func (s *SyncManager) extractFileChangePayload(payload interface{}) (*FileChangePayload, bool) {
 	if payload == nil {
 		return nil, false
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// This file persists AuthManager's device tokens to tokenStorePath so a
+// restart doesn't silently log out every device (the pre-chunk1-6 behavior,
+// when deviceTokens was memory-only). The store is a single ChaCha20-
+// Poly1305-sealed blob keyed by a value derived from the master token via
+// HKDF, rather than the master token itself, so the on-disk file doesn't
+// double as a second copy of the server's root credential.
+
+// tokenStoreKey derives the symmetric key used to seal the token store from
+// the server's master token, so no separate secret needs provisioning just
+// to protect tokens already protected by possession of the master token.
+func tokenStoreKey(masterToken string) []byte {
+	h := hkdf.New(sha256.New, []byte(masterToken), nil, []byte("vault-sync token store v1"))
+	key := make([]byte, chacha20poly1305.KeySize)
+	_, _ = io.ReadFull(h, key) // Can't fail: hkdf.Reader only errors past the 255*hash-size expansion limit.
+	return key
+}
+
+// loadTokens reads and decrypts a.tokenStorePath into a.deviceTokens, if it
+// exists. A missing file just means no tokens have been persisted yet.
+func (a *AuthManager) loadTokens() error {
+	if a.tokenStorePath == "" {
+		return nil
+	}
+
+	blob, err := os.ReadFile(a.tokenStorePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	aead, err := chacha20poly1305.New(tokenStoreKey(a.masterToken))
+	if err != nil {
+		return err
+	}
+	if len(blob) < aead.NonceSize() {
+		return fmt.Errorf("token store %s is truncated", a.tokenStorePath)
+	}
+	nonce, ciphertext := blob[:aead.NonceSize()], blob[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return fmt.Errorf("decrypting token store (wrong master token?): %w", err)
+	}
+
+	var tokens []*DeviceToken
+	if err := json.Unmarshal(plaintext, &tokens); err != nil {
+		return fmt.Errorf("parsing token store: %w", err)
+	}
+
+	for _, dt := range tokens {
+		a.deviceTokens[dt.DeviceID] = dt
+	}
+	return nil
+}
+
+// persistTokensLocked encrypts and writes the current device token table to
+// a.tokenStorePath. Callers must hold a.mu. Rotation's retired grace-window
+// tokens are intentionally not included - see the comment on
+// AuthManager.retired.
+func (a *AuthManager) persistTokensLocked() error {
+	if a.tokenStorePath == "" {
+		return nil
+	}
+
+	tokens := make([]*DeviceToken, 0, len(a.deviceTokens))
+	for _, dt := range a.deviceTokens {
+		tokens = append(tokens, dt)
+	}
+
+	plaintext, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+
+	aead, err := chacha20poly1305.New(tokenStoreKey(a.masterToken))
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	blob := aead.Seal(nonce, nonce, plaintext, nil)
+
+	tmpPath := a.tokenStorePath + ".tmp"
+	if err := os.WriteFile(tmpPath, blob, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, a.tokenStorePath)
+}
@@ -1,9 +1,17 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -22,6 +30,7 @@ type Client struct {
 	conn     *websocket.Conn
 	deviceID string
 	send     chan []byte
+	mux      *MuxServer
 }
 
 type Hub struct {
@@ -30,6 +39,15 @@ type Hub struct {
 	register   chan *Client
 	unregister chan *Client
 	mu         sync.RWMutex
+
+	globalSem         *byteSemaphore
+	perDeviceMaxBytes int64
+	deviceSems        map[string]*byteSemaphore
+	deviceLimits      map[string]int64
+	semMu             sync.Mutex
+
+	outboundQueue *OutboundQueue
+	retryPolicy   RetryPolicy
 }
 
 type BroadcastMessage struct {
@@ -37,12 +55,65 @@ type BroadcastMessage struct {
 	message []byte
 }
 
-func NewHub() *Hub {
-	return &Hub{
-		clients:    make(map[string]*Client),
-		broadcast:  make(chan *BroadcastMessage, 256),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
+// NewHub wires up the in-memory client registry plus, if queueDir is
+// non-empty, a per-device OutboundQueue that persists messages a client
+// missed while disconnected or backed up, redelivered with retryPolicy's
+// backoff on reconnect.
+func NewHub(maxInFlightMB, perDeviceMaxRequestKiB int, queueDir string, retryPolicy RetryPolicy) (*Hub, error) {
+	hub := &Hub{
+		clients:           make(map[string]*Client),
+		broadcast:         make(chan *BroadcastMessage, 256),
+		register:          make(chan *Client),
+		unregister:        make(chan *Client),
+		globalSem:         newByteSemaphore(int64(maxInFlightMB) * 1024 * 1024),
+		perDeviceMaxBytes: int64(perDeviceMaxRequestKiB) * 1024,
+		deviceSems:        make(map[string]*byteSemaphore),
+		deviceLimits:      make(map[string]int64),
+		retryPolicy:       retryPolicy,
+	}
+
+	if queueDir != "" {
+		queue, err := NewOutboundQueue(queueDir)
+		if err != nil {
+			return nil, err
+		}
+		hub.outboundQueue = queue
+	}
+
+	return hub, nil
+}
+
+// deviceSemaphore returns the per-device byte semaphore for deviceID,
+// creating it on first use with the configured default (or an operator
+// override set via SetDeviceLimit).
+func (h *Hub) deviceSemaphore(deviceID string) *byteSemaphore {
+	h.semMu.Lock()
+	defer h.semMu.Unlock()
+
+	sem, ok := h.deviceSems[deviceID]
+	if ok {
+		return sem
+	}
+
+	max := h.perDeviceMaxBytes
+	if override, ok := h.deviceLimits[deviceID]; ok {
+		max = override
+	}
+	sem = newByteSemaphore(max)
+	h.deviceSems[deviceID] = sem
+	return sem
+}
+
+// SetDeviceLimit overrides the per-device in-flight byte cap for deviceID,
+// applying immediately if the device already has an active semaphore.
+func (h *Hub) SetDeviceLimit(deviceID string, maxBytes int64) {
+	h.semMu.Lock()
+	h.deviceLimits[deviceID] = maxBytes
+	sem, ok := h.deviceSems[deviceID]
+	h.semMu.Unlock()
+
+	if ok {
+		sem.setMax(maxBytes)
 	}
 }
 
@@ -60,6 +131,12 @@ func (h *Hub) Run() {
 			h.mu.Unlock()
 			log.Printf("Device connected: %s (total: %d)", client.deviceID, len(h.clients))
 
+			if h.outboundQueue != nil {
+				go h.outboundQueue.DrainWithRetry(client.deviceID, h.retryPolicy, func(raw json.RawMessage) error {
+					return h.SendRaw(client.deviceID, raw)
+				})
+			}
+
 		case client := <-h.unregister:
 			h.mu.Lock()
 			if existing, ok := h.clients[client.deviceID]; ok && existing == client {
@@ -76,8 +153,17 @@ func (h *Hub) Run() {
 					select {
 					case client.send <- msg.message:
 					default:
-						// Client buffer full, skip
-						log.Printf("Skipping message to %s: buffer full", deviceID)
+						// Client buffer full - queue for redelivery instead
+						// of dropping it on the floor.
+						log.Printf("Buffer full for %s, queueing for retry", deviceID)
+						if h.outboundQueue != nil {
+							if err := h.outboundQueue.Enqueue(deviceID, QueuedMessage{
+								Message:  msg.message,
+								QueuedAt: time.Now().UnixNano(),
+							}); err != nil {
+								log.Printf("Failed to queue message for %s: %v", deviceID, err)
+							}
+						}
 					}
 				}
 			}
@@ -95,26 +181,86 @@ func (h *Hub) Broadcast(origin string, msg interface{}) error {
 	return nil
 }
 
+// SendTo delivers msg to deviceID if connected and not backed up. Otherwise
+// it's persisted to that device's OutboundQueue (if one is configured) so
+// it can be redelivered once the device reconnects.
 func (h *Hub) SendTo(deviceID string, msg interface{}) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	if h.SendRaw(deviceID, data) == nil {
+		return nil
+	}
+
+	if h.outboundQueue != nil {
+		path := ""
+		if sm, ok := msg.(ServerMessage); ok {
+			path = extractMessagePath(sm.Payload)
+		}
+		if err := h.outboundQueue.Enqueue(deviceID, QueuedMessage{
+			Path:     path,
+			Message:  data,
+			QueuedAt: time.Now().UnixNano(),
+		}); err != nil {
+			log.Printf("Failed to queue message for %s: %v", deviceID, err)
+		}
+	}
+	return nil
+}
+
+// SendRaw writes an already-marshaled message directly to deviceID's send
+// channel, returning an error if the device isn't connected or its buffer
+// is full so callers (e.g. queue redelivery) can retry.
+func (h *Hub) SendRaw(deviceID string, data []byte) error {
 	h.mu.RLock()
 	client, ok := h.clients[deviceID]
 	h.mu.RUnlock()
 
 	if !ok {
-		return nil // Client not connected
-	}
-
-	data, err := json.Marshal(msg)
-	if err != nil {
-		return err
+		return fmt.Errorf("device %s not connected", deviceID)
 	}
 
 	select {
 	case client.send <- data:
+		return nil
 	default:
-		return nil // Buffer full
+		return fmt.Errorf("send buffer full for %s", deviceID)
 	}
-	return nil
+}
+
+// extractMessagePath pulls the file path out of the server message payload
+// types that carry one, so the outbound queue can supersede a stale queued
+// entry with a newer one for the same path.
+func extractMessagePath(payload interface{}) string {
+	switch p := payload.(type) {
+	case *FileChangePayload:
+		return p.Path
+	case *FileDeletePayload:
+		return p.Path
+	case *FileMovePayload:
+		return p.NewPath
+	case *FileManifest:
+		return p.Path
+	}
+	return ""
+}
+
+// CloseDevice forcibly closes deviceID's connection, if any, triggering the
+// normal unregister/cleanup path. Used by the fault-injection debug
+// endpoint so integration tests can exercise reconnect+resync
+// deterministically.
+func (h *Hub) CloseDevice(deviceID string) bool {
+	h.mu.RLock()
+	client, ok := h.clients[deviceID]
+	h.mu.RUnlock()
+
+	if !ok {
+		return false
+	}
+	client.conn.Close()
+	return true
 }
 
 func (h *Hub) GetConnectedDevices() []string {
@@ -129,41 +275,102 @@ func (h *Hub) GetConnectedDevices() []string {
 }
 
 type WSHandler struct {
-	hub     *Hub
-	sync    *SyncManager
-	auth    *AuthManager
-	storage *Storage
+	hub            *Hub
+	sync           *SyncManager
+	auth           *AuthManager
+	storage        StorageBackend
+	locks          *LockManager
+	tlsEnabled     bool
+	faultInjection FaultInjectionConfig
 }
 
-func NewWSHandler(hub *Hub, sync *SyncManager, auth *AuthManager, storage *Storage) *WSHandler {
+func NewWSHandler(hub *Hub, sync *SyncManager, auth *AuthManager, storage StorageBackend, locks *LockManager, tlsEnabled bool, faultInjection FaultInjectionConfig) *WSHandler {
 	return &WSHandler{
-		hub:     hub,
-		sync:    sync,
-		auth:    auth,
-		storage: storage,
+		hub:            hub,
+		sync:           sync,
+		auth:           auth,
+		storage:        storage,
+		locks:          locks,
+		tlsEnabled:     tlsEnabled,
+		faultInjection: faultInjection,
 	}
 }
 
-func (h *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Get token from query parameter or header
-	token := r.URL.Query().Get("token")
-	if token == "" {
-		token = r.Header.Get("X-Auth-Token")
+// injectLatency sleeps for the configured fault-injection latency, if
+// enabled. Used by writePump to simulate a slow, unreliable link.
+func (h *WSHandler) injectLatency() {
+	if h.faultInjection.Enabled && h.faultInjection.LatencyMs > 0 {
+		time.Sleep(time.Duration(h.faultInjection.LatencyMs) * time.Millisecond)
 	}
+}
 
-	deviceID, ok := h.auth.ValidateToken(token)
-	if !ok {
+// injectWriteFailure rolls the dice on dropping an outbound write, if
+// fault injection is enabled.
+func (h *WSHandler) injectWriteFailure() bool {
+	return h.faultInjection.Enabled && h.faultInjection.WriteFailureProbability > 0 &&
+		rand.Float64() < h.faultInjection.WriteFailureProbability
+}
+
+// injectDisconnect rolls the dice on forcibly closing the connection, if
+// fault injection is enabled.
+func (h *WSHandler) injectDisconnect() bool {
+	return h.faultInjection.Enabled && h.faultInjection.DisconnectProbability > 0 &&
+		rand.Float64() < h.faultInjection.DisconnectProbability
+}
+
+// authenticateDevice proves the connecting device controls the private key
+// behind its claimed device_id — via the TLS client certificate when
+// mutual TLS is enabled, or a signed challenge nonce (from
+// /api/devices/challenge) otherwise. The master token is deliberately not
+// accepted here: it only authorizes admin HTTP endpoints, never /ws, so it
+// can no longer be used to spoof an arbitrary device_id.
+func (h *WSHandler) authenticateDevice(r *http.Request) (deviceID string, pubKeyDER []byte, err error) {
+	deviceID = r.URL.Query().Get("device_id")
+	if deviceID == "" {
+		return "", nil, errors.New("device_id required")
+	}
+
+	if h.tlsEnabled && r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		pubKeyDER = r.TLS.PeerCertificates[0].RawSubjectPublicKeyInfo
+		derivedID, err := DeriveDeviceID(pubKeyDER)
+		if err != nil {
+			return "", nil, err
+		}
+		if derivedID != deviceID {
+			return "", nil, ErrInvalidDeviceID
+		}
+		return deviceID, pubKeyDER, nil
+	}
+
+	pubKeyDER, err = base64.StdEncoding.DecodeString(r.Header.Get("X-Device-Public-Key"))
+	if err != nil {
+		return "", nil, fmt.Errorf("decoding public key: %w", err)
+	}
+	nonce := r.Header.Get("X-Device-Nonce")
+	signature, err := base64.StdEncoding.DecodeString(r.Header.Get("X-Device-Signature"))
+	if err != nil {
+		return "", nil, fmt.Errorf("decoding signature: %w", err)
+	}
+
+	if err := h.auth.VerifyDeviceHandshake(deviceID, pubKeyDER, nonce, signature); err != nil {
+		return "", nil, err
+	}
+
+	return deviceID, pubKeyDER, nil
+}
+
+func (h *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	deviceID, pubKeyDER, err := h.authenticateDevice(r)
+	if err != nil {
+		log.Printf("Device handshake rejected: %v", err)
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	// Get device ID from query if not using device token
-	if deviceID == "master" {
-		deviceID = r.URL.Query().Get("device_id")
-		if deviceID == "" {
-			http.Error(w, "device_id required", http.StatusBadRequest)
-			return
-		}
+	if !h.auth.IsTrusted(deviceID, pubKeyDER) {
+		h.auth.RequestDeviceApproval(deviceID, pubKeyDER, r.URL.Query().Get("name"))
+		http.Error(w, "Device pending operator approval", http.StatusForbidden)
+		return
 	}
 
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -177,6 +384,7 @@ func (h *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		deviceID: deviceID,
 		send:     make(chan []byte, 256),
 	}
+	client.mux = h.newMuxServer(client)
 
 	h.hub.register <- client
 
@@ -184,9 +392,305 @@ func (h *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	go h.readPump(client)
 }
 
+// HandleDeviceLimits lets an operator override the per-device in-flight
+// byte cap for a connected (or not-yet-connected) device, e.g.
+// POST /api/devices/<id>/limits {"max_request_kib": 8192}
+func (h *WSHandler) HandleDeviceLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" || authHeader != "Bearer "+h.auth.masterToken {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, "/api/devices/")
+	deviceID := strings.TrimSuffix(rest, "/limits")
+	if deviceID == "" || deviceID == rest {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		MaxRequestKiB int64 `json:"max_request_kib"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.MaxRequestKiB <= 0 {
+		http.Error(w, "max_request_kib must be positive", http.StatusBadRequest)
+		return
+	}
+
+	h.hub.SetDeviceLimit(deviceID, req.MaxRequestKiB*1024)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device_id":       deviceID,
+		"max_request_kib": req.MaxRequestKiB,
+	})
+}
+
+// HandleDebugRestartClient forcibly closes a connected device's socket so
+// integration tests can exercise the reconnect+resync path deterministically,
+// e.g. POST /api/debug/restart-client/<deviceID>. Intended for use alongside
+// FaultInjection in test environments, not production.
+func (h *WSHandler) HandleDebugRestartClient(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" || authHeader != "Bearer "+h.auth.masterToken {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	deviceID := strings.TrimPrefix(r.URL.Path, "/api/debug/restart-client/")
+	if deviceID == "" {
+		http.Error(w, "device id required", http.StatusBadRequest)
+		return
+	}
+
+	if !h.hub.CloseDevice(deviceID) {
+		http.Error(w, "Device not connected", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"device_id": deviceID, "status": "restarted"})
+}
+
+// HandleChunksHave answers the pre-upload "have these chunks?" check for
+// content-defined chunked uploads (see chunkstore.go): the client sends the
+// hashes it's about to upload, and gets back only the ones actually
+// missing, so re-saving or moving a file within the vault costs no more
+// bandwidth than its genuinely new content.
+func (h *WSHandler) HandleChunksHave(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, scopes, ok := h.auth.Authenticate(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !hasScope(scopes, "read") {
+		http.Error(w, "Token does not grant read scope", http.StatusForbidden)
+		return
+	}
+
+	chunkStore, ok := h.storage.(ChunkStore)
+	if !ok {
+		http.Error(w, "Storage backend does not support chunked uploads", http.StatusNotImplemented)
+		return
+	}
+
+	var req struct {
+		Hashes []string `json:"hashes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	missing := make([]string, 0, len(req.Hashes))
+	for _, hash := range req.Hashes {
+		if !chunkStore.HasChunk(hash) {
+			missing = append(missing, hash)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"missing": missing})
+}
+
+// HandleChunkUpload stores one content-defined chunk, e.g.
+// POST /api/chunks/<hash> with the chunk's raw bytes as the body. Rejects
+// the chunk if its SHA-256 doesn't match hash, so a client can't poison the
+// dedup store with content under the wrong key.
+func (h *WSHandler) HandleChunkUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, scopes, ok := h.auth.Authenticate(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !hasScope(scopes, "write") {
+		http.Error(w, "Token does not grant write scope", http.StatusForbidden)
+		return
+	}
+
+	chunkStore, ok := h.storage.(ChunkStore)
+	if !ok {
+		http.Error(w, "Storage backend does not support chunked uploads", http.StatusNotImplemented)
+		return
+	}
+
+	hash := strings.TrimPrefix(r.URL.Path, "/api/chunks/")
+	if hash == "" {
+		http.Error(w, "chunk hash required", http.StatusBadRequest)
+		return
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read chunk body", http.StatusBadRequest)
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != hash {
+		http.Error(w, "chunk content does not match hash", http.StatusBadRequest)
+		return
+	}
+
+	if err := chunkStore.WriteChunk(hash, data); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to store chunk: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"hash": hash, "status": "stored"})
+}
+
+// HandleChunkManifest finalizes a chunked upload: the client PUTs the
+// ChunkManifest listing every chunk that makes up the file (all of which
+// must already be stored via HandleChunkUpload or deduped from an earlier
+// upload), and the server reconstructs and writes the file exactly as if
+// it had been uploaded whole, so GetFileHash/FileInfo.Hash keep reporting
+// the same whole-file SHA-256 regardless of which upload path was used.
+func (h *WSHandler) HandleChunkManifest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deviceID, scopes, ok := h.auth.Authenticate(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	chunkStore, ok := h.storage.(ChunkStore)
+	if !ok {
+		http.Error(w, "Storage backend does not support chunked uploads", http.StatusNotImplemented)
+		return
+	}
+
+	var m ChunkManifest
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil || m.Path == "" {
+		http.Error(w, "Invalid manifest body", http.StatusBadRequest)
+		return
+	}
+
+	if !pathScopeAllows(scopes, "write", m.Path) {
+		http.Error(w, "Token does not grant write scope for this path", http.StatusForbidden)
+		return
+	}
+
+	if h.locks != nil {
+		if err := h.locks.CheckWritable(m.Path, deviceID); err != nil {
+			var conflict *LockConflictError
+			if errors.As(err, &conflict) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusLocked)
+				json.NewEncoder(w).Encode(map[string]string{"error": conflict.Error(), "holder": conflict.Holder})
+				return
+			}
+		}
+	}
+
+	content, err := chunkStore.ReconstructFromChunkManifest(&m)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to reconstruct file: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	sum := sha256.Sum256(content)
+	if hex.EncodeToString(sum[:]) != m.TotalHash {
+		http.Error(w, "reconstructed content does not match totalHash", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storage.WriteFile(m.Path, content, m.MTime); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to write file: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := chunkStore.SaveChunkManifest(m.Path, &m); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save chunk manifest: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"path": m.Path, "status": "written"})
+}
+
+// newMuxServer wires up the grid layer for one connection: SingleRequest
+// for small ops that fit in one round trip, StreamRequest for chunked file
+// transfer.
+func (h *WSHandler) newMuxServer(client *Client) *MuxServer {
+	mux := NewMuxServer(func(f Frame) error {
+		data, err := json.Marshal(f)
+		if err != nil {
+			return err
+		}
+		select {
+		case client.send <- data:
+			return nil
+		default:
+			return fmt.Errorf("send buffer full for %s", client.deviceID)
+		}
+	})
+
+	mux.SingleRequest("ping", func(initial []byte) ([]byte, error) {
+		return []byte(`{}`), nil
+	})
+
+	mux.SingleRequest("tombstones", func(initial []byte) ([]byte, error) {
+		return json.Marshal(h.storage.ListTombstones())
+	})
+
+	mux.SingleRequest("request_file_info", func(initial []byte) ([]byte, error) {
+		var req struct {
+			Path string `json:"path"`
+		}
+		if err := json.Unmarshal(initial, &req); err != nil {
+			return nil, err
+		}
+		info, err := h.storage.GetFileInfo(req.Path)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(info)
+	})
+
+	mux.StreamRequest("file_upload", func(initial []byte, in <-chan []byte, aborted func() bool) (<-chan []byte, error) {
+		return h.sync.HandleStreamUpload(client.deviceID, initial, in, aborted)
+	})
+
+	mux.StreamRequest("file_download", func(initial []byte, in <-chan []byte, aborted func() bool) (<-chan []byte, error) {
+		return h.sync.HandleStreamDownload(client.deviceID, initial)
+	})
+
+	return mux
+}
+
 func (h *WSHandler) readPump(client *Client) {
 	defer func() {
 		h.hub.unregister <- client
+		client.mux.CloseAll()
 		client.conn.Close()
 	}()
 
@@ -206,9 +710,34 @@ func (h *WSHandler) readPump(client *Client) {
 			break
 		}
 
+		if h.injectDisconnect() {
+			log.Printf("Fault injection: forcing disconnect of %s", client.deviceID)
+			break
+		}
+
+		// Bound in-flight memory: block until both the global and
+		// per-device budgets have room for this message.
+		n := int64(len(message))
+		h.hub.globalSem.take(n)
+		deviceSem := h.hub.deviceSemaphore(client.deviceID)
+		deviceSem.take(n)
+
+		// Grid layer: a non-zero streamId means this is a multiplexed
+		// frame (chunked upload/download or a single small request)
+		// rather than the legacy one-message-one-file envelope.
+		if frame, ok := decodeFrame(message); ok {
+			h.auth.UpdateLastSeen(client.deviceID)
+			client.mux.HandleFrame(frame)
+			deviceSem.give(n)
+			h.hub.globalSem.give(n)
+			continue
+		}
+
 		var msg SyncMessage
 		if err := json.Unmarshal(message, &msg); err != nil {
 			log.Printf("Invalid message from %s: %v", client.deviceID, err)
+			deviceSem.give(n)
+			h.hub.globalSem.give(n)
 			continue
 		}
 
@@ -217,6 +746,9 @@ func (h *WSHandler) readPump(client *Client) {
 
 		// Handle message
 		h.sync.HandleMessage(client.deviceID, &msg)
+
+		deviceSem.give(n)
+		h.hub.globalSem.give(n)
 	}
 }
 
@@ -236,13 +768,29 @@ func (h *WSHandler) writePump(client *Client) {
 				return
 			}
 
+			h.injectLatency()
+			if h.injectWriteFailure() {
+				log.Printf("Fault injection: dropping write to %s", client.deviceID)
+				continue
+			}
+
+			n := int64(len(message))
+			h.hub.globalSem.take(n)
+			deviceSem := h.hub.deviceSemaphore(client.deviceID)
+			deviceSem.take(n)
+
 			w, err := client.conn.NextWriter(websocket.TextMessage)
 			if err != nil {
+				deviceSem.give(n)
+				h.hub.globalSem.give(n)
 				return
 			}
 			w.Write(message)
 
-			if err := w.Close(); err != nil {
+			closeErr := w.Close()
+			deviceSem.give(n)
+			h.hub.globalSem.give(n)
+			if closeErr != nil {
 				return
 			}
 